@@ -0,0 +1,54 @@
+// Command mqd serves a mq.Queue over HTTP, see mqhttp.Handler for routes.
+// Stats are served at /metrics in Prometheus text format, and at /debug/vars by expvar.
+package main
+
+import (
+	"expvar"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/justmao945/tama/mq"
+	"github.com/justmao945/tama/mq/mqhttp"
+)
+
+func main() {
+	path := flag.String("path", "mq", "path of the queue volume")
+	addr := flag.String("addr", ":8080", "address to listen")
+	syncPuts := flag.Int("sync-puts", 0, "sync a topic after every N puts, 0 to disable")
+	syncInterval := flag.Duration("sync-interval", time.Second, "sync the queue every interval, 0 to disable")
+	flag.Parse()
+
+	cfg := *mq.DefaultConfig
+	cfg.SyncPuts = *syncPuts
+	cfg.SyncInterval = *syncInterval
+	q, err := mq.NewQueue(*path, &cfg)
+	if err != nil {
+		log.Fatalln("open queue failed:", err)
+	}
+
+	expvar.Publish("mq", q.Var())
+	mux := http.NewServeMux()
+	mux.Handle("/", mqhttp.NewHandler(q))
+	mux.Handle("/metrics", q.PrometheusHandler())
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	srv := &http.Server{Addr: *addr, Handler: mux}
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+		<-c
+		srv.Close()
+	}()
+
+	log.Println("mqd listening on", *addr)
+	err = srv.ListenAndServe()
+	q.Close()
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatalln("serve failed:", err)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"os"
 	"reflect"
 	"unsafe"
 )
@@ -13,6 +14,10 @@ const (
 	blockHeaderSize = 128 // > sizeof(block{})
 )
 
+const (
+	blockFree = 1 << iota // block is released and can be reused by any file
+)
+
 var (
 	blockMagic = binary.LittleEndian.Uint32([]byte{'m', 'f', 's', 'b'})
 )
@@ -42,7 +47,7 @@ type block struct {
 	cap   int32  // 4B block cap to store data, excluding header
 	fd    uint32 // 4B owner file
 	idx   int32  // 4B n-th block of owner file
-	flag  int64  // 8B reserved
+	flag  int64  // 8B block flags
 	data  []byte // 24
 }
 
@@ -86,6 +91,29 @@ func (b *block) WriteAt(d []byte, off int32) (n int, err error) {
 	return
 }
 
+// Sync flushes header and data of this block to disk.
+func (b *block) Sync() error {
+	start := uintptr(unsafe.Pointer(b))
+	end := start + blockHeaderSize + uintptr(b.cap)
+	start &^= uintptr(os.Getpagesize() - 1) // page aligned
+	return msync(start, end-start)
+}
+
+// SyncRange flushes header and data [off, off+n) of this block to disk.
+func (b *block) SyncRange(off, n int32) (err error) {
+	page := uintptr(os.Getpagesize() - 1)
+	start := uintptr(unsafe.Pointer(b))
+	err = msync(start&^page, start+blockHeaderSize-start&^page)
+	if err != nil {
+		return
+	}
+
+	start += blockHeaderSize + uintptr(off)
+	end := start + uintptr(n)
+	start &^= page
+	return msync(start, end-start)
+}
+
 // ------------------------------------------------------------------
 
 // map struct block into bytes array
@@ -127,6 +155,18 @@ func newBlock(addr []byte, fd uint32, idx, cap int32) (b *block, err error) {
 	return
 }
 
+// reuse a released block for another file
+func (b *block) reset(fd uint32, idx int32) {
+	if b.flag&blockFree == 0 {
+		panic("reuse a block in use")
+	}
+	fillZero(b.data)
+	b.fd = fd
+	b.idx = idx
+	b.size = 0
+	b.flag &^= blockFree // clear free flag at last, block is still free if crashed before
+}
+
 // open an exist block at addr
 func openBlock(addr []byte) (b *block, err error) {
 	b = mapBlock(addr)
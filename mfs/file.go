@@ -3,15 +3,17 @@ package mfs
 import (
 	"fmt"
 	"io"
+	"sort"
 	"sync"
 )
 
 // File is a high level interface which can be read or write at specified offset.
 type File struct {
-	v       *Volume  // root
-	fd      uint32   // unique number on a volume
-	blkSize int32    // logical block size, excluding header size
-	blks    []*block // may contain nil, block idx: off / blkSize, off in block = off % blkSize
+	v       *Volume          // root
+	fd      uint32           // unique number on a volume
+	blkSize int32            // logical block size, excluding header size
+	blks    map[int32]*block // missing block is a file hole, block idx: off / blkSize, off in block = off % blkSize
+	n       int32            // logical block num, reading after that returns EOF
 	l       sync.RWMutex
 }
 
@@ -23,7 +25,7 @@ func (f *File) String() string {
 }
 
 func newFile(v *Volume, fd uint32, blkSize int32) *File {
-	return &File{v: v, fd: fd, blkSize: blkSize}
+	return &File{v: v, fd: fd, blkSize: blkSize, blks: make(map[int32]*block)}
 }
 
 // Add a block to this file
@@ -31,31 +33,29 @@ func (f *File) add(b *block) {
 	if b.fd != f.fd {
 		panic("add block not owned by this file")
 	}
-	if int(b.idx) < len(f.blks) { // add a block in file hole
+	if b.idx < f.n { // add a block in file hole
 		if f.blks[b.idx] != nil {
 			panic("already have block")
 		}
 		b.size = b.cap // resize the file hole
-	} else if len(f.blks) > 0 { // add new block
-		last := f.blks[len(f.blks)-1]
-		last.size = last.cap // resize the previous last one block
-	}
-
-	for i := len(f.blks); i <= int(b.idx); i++ {
-		f.blks = append(f.blks, nil) // FIXME: use map to replace array ?
+	} else {
+		if last := f.blks[f.n-1]; last != nil { // add new block
+			last.size = last.cap // resize the previous last one block
+		}
+		f.n = b.idx + 1
 	}
 	f.blks[b.idx] = b
 }
 
 // may return nil block, which means a file hole
 func (f *File) getReadBlock(off int64) (b *block, boff int32, err error) {
-	idx := int(off / int64(f.blkSize))
+	idx := int32(off / int64(f.blkSize))
 	boff = int32(off % int64(f.blkSize))
 
 	f.l.RLock()
 	defer f.l.RUnlock()
 
-	if idx < len(f.blks) {
+	if idx < f.n {
 		b = f.blks[idx]
 	} else {
 		err = io.EOF
@@ -65,13 +65,11 @@ func (f *File) getReadBlock(off int64) (b *block, boff int32, err error) {
 
 // always return a non-nil block to write
 func (f *File) getWriteBlock(off int64) (b *block, boff int32, err error) {
-	idx := int(off / int64(f.blkSize))
+	idx := int32(off / int64(f.blkSize))
 	boff = int32(off % int64(f.blkSize))
 
 	f.l.RLock()
-	if idx < len(f.blks) {
-		b = f.blks[idx]
-	}
+	b = f.blks[idx]
 	f.l.RUnlock()
 
 	if b != nil {
@@ -81,14 +79,12 @@ func (f *File) getWriteBlock(off int64) (b *block, boff int32, err error) {
 	f.l.Lock()
 	defer f.l.Unlock()
 
-	if idx < len(f.blks) {
-		b = f.blks[idx]
-	}
+	b = f.blks[idx]
 	if b != nil {
 		return
 	}
 
-	b, err = f.v.alloc(f.fd, int32(idx), f.blkSize)
+	b, err = f.v.alloc(f.fd, idx, f.blkSize)
 	if err != nil {
 		return
 	}
@@ -101,7 +97,7 @@ func (f *File) Fd() uint32 {
 	return f.fd
 }
 
-//ReadAt implements io.ReaderAt
+// ReadAt implements io.ReaderAt
 func (f *File) ReadAt(b []byte, off int64) (n int, err error) {
 	blk, boff, err := f.getReadBlock(off)
 	if err != nil {
@@ -112,6 +108,10 @@ func (f *File) ReadAt(b []byte, off int64) (n int, err error) {
 		nn := min(len(b), int(f.blkSize-boff)) // need fill nn zeros to b
 		n = fillZero(b[:nn])
 	} else {
+		if boff > blk.size { // after the end of last block
+			err = io.EOF
+			return
+		}
 		nn := min(len(b), int(blk.size-boff)) // need read nn bytes in this block
 		n, err = blk.ReadAt(b[:nn], boff)     // read first nn bytes to b at off
 		if err != nil {
@@ -158,3 +158,59 @@ func (f *File) WriteAt(b []byte, off int64) (n int, err error) {
 	n += n1
 	return
 }
+
+// Discard releases all blocks entirely within [off, off+n) back to the volume,
+// the released range becomes a file hole and reads as zeros.
+func (f *File) Discard(off, n int64) {
+	first := (off + int64(f.blkSize) - 1) / int64(f.blkSize) // first whole block
+	last := (off + n) / int64(f.blkSize)                     // block after the last whole one
+
+	var blks []*block
+
+	f.l.Lock()
+	for i, b := range f.blks {
+		if int64(i) >= first && int64(i) < last {
+			blks = append(blks, b)
+			delete(f.blks, i)
+		}
+	}
+	f.l.Unlock()
+
+	if len(blks) > 0 {
+		sort.Sort(byBlkIdx(blks)) // release in order, the last block is released at last
+		f.v.release(blks)
+	}
+}
+
+// Sync flushes all blocks of this file to disk.
+func (f *File) Sync() (err error) {
+	f.l.RLock()
+	defer f.l.RUnlock()
+
+	for _, b := range f.blks {
+		err = b.Sync()
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// SyncRange flushes blocks of this file in [off, off+n) to disk, holes are skipped.
+func (f *File) SyncRange(off, n int64) (err error) {
+	f.l.RLock()
+	defer f.l.RUnlock()
+
+	for end := off + n; off < end; {
+		boff := int32(off % int64(f.blkSize))
+		nn := int32(min(int(end-off), int(f.blkSize-boff))) // need sync nn bytes in this block
+		if b, ok := f.blks[int32(off/int64(f.blkSize))]; ok {
+			err = b.SyncRange(boff, nn)
+			if err != nil {
+				return
+			}
+		}
+		off += int64(nn)
+	}
+	return
+}
@@ -6,6 +6,7 @@ import (
 	"os"
 	"path"
 	"syscall"
+	"unsafe"
 )
 
 var (
@@ -103,9 +104,13 @@ func newRound(v *Volume, idx int, size int64, blkSize int32) (r *round, err erro
 	return
 }
 
-// Load iterates all blocks and it to the corresponding file.
-func (r *round) Load(files map[uint32]*File) {
+// Load iterates all blocks and it to the corresponding file, returns released blocks.
+func (r *round) Load(files map[uint32]*File) (free []*block) {
 	for _, b := range r.blks {
+		if b.flag&blockFree != 0 {
+			free = append(free, b)
+			continue
+		}
 		f, ok := files[b.fd]
 		if !ok {
 			f = newFile(r.v, b.fd, r.blkSize)
@@ -113,6 +118,7 @@ func (r *round) Load(files map[uint32]*File) {
 		}
 		f.add(b)
 	}
+	return
 }
 
 // Close the underlying mmap addr.
@@ -120,6 +126,11 @@ func (r *round) Close() error {
 	return syscall.Munmap(r.addr)
 }
 
+// Sync flushes the whole round to disk.
+func (r *round) Sync() error {
+	return msync(uintptr(unsafe.Pointer(&r.addr[0])), uintptr(len(r.addr)))
+}
+
 // Alloc returns a block in this round if is available.
 func (r *round) Alloc(fd uint32, idx, cap int32) (b *block, err error) {
 	if r.Full() {
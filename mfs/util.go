@@ -1,5 +1,7 @@
 package mfs
 
+import "syscall"
+
 func min(a, b int) int {
 	if a < b {
 		return a
@@ -27,3 +29,19 @@ type byFd []*File
 func (f byFd) Len() int           { return len(f) }
 func (f byFd) Less(i, j int) bool { return f[i].fd < f[j].fd }
 func (f byFd) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+
+// msync flushes mapped memory [addr, addr+n) to disk, addr must be page aligned.
+func msync(addr, n uintptr) (err error) {
+	_, _, e := syscall.Syscall(syscall.SYS_MSYNC, addr, n, syscall.MS_SYNC)
+	if e != 0 {
+		err = e
+	}
+	return
+}
+
+// byBlkIdx implements sort.Interface.
+type byBlkIdx []*block
+
+func (b byBlkIdx) Len() int           { return len(b) }
+func (b byBlkIdx) Less(i, j int) bool { return b[i].idx < b[j].idx }
+func (b byBlkIdx) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
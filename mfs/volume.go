@@ -3,6 +3,7 @@ package mfs
 import (
 	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
 	"sort"
 	"strconv"
@@ -27,6 +28,7 @@ type Volume struct {
 	name  string
 	files map[uint32]*File
 	rnds  []*round
+	free  []*block // released blocks, reused before allocating new ones
 	l     sync.RWMutex
 }
 
@@ -86,15 +88,17 @@ func Open(name string, cfg *Config) (v *Volume, err error) {
 
 	files := make(map[uint32]*File)
 
+	var free []*block
 	for i, r := range rnds {
 		if r.idx != i {
 			panic("invalid load order")
 		}
-		r.Load(files) // must be loaded from 0 to ...
+		free = append(free, r.Load(files)...) // must be loaded from 0 to ...
 	}
 
 	v0.rnds = rnds
 	v0.files = files
+	v0.free = free
 	v = v0
 	return
 }
@@ -139,6 +143,19 @@ func (v *Volume) Open(fd uint32) (f *File, err error) {
 	return
 }
 
+// Remove releases all blocks of a file, the file should not be used after removed.
+// Blocks are released in order, so the last block is kept if crashed while removing.
+func (v *Volume) Remove(fd uint32) {
+	v.l.Lock()
+	f, ok := v.files[fd]
+	delete(v.files, fd)
+	v.l.Unlock()
+
+	if ok {
+		f.Discard(0, math.MaxInt64)
+	}
+}
+
 // Close unmap all mapped files
 func (v *Volume) Close() {
 	v.l.Lock()
@@ -149,11 +166,60 @@ func (v *Volume) Close() {
 	}
 }
 
+// Stat is the space usage of a volume.
+type Stat struct {
+	Rounds     int   // rounds allocated
+	Size       int64 // bytes of all rounds on disk
+	Blocks     int   // blocks allocated from rounds, including free ones
+	FreeBlocks int   // released blocks waiting for reuse
+	Used       int64 // bytes of blocks used by files
+}
+
+// Stat returns the space usage of this volume.
+func (v *Volume) Stat() (s Stat) {
+	v.l.RLock()
+	defer v.l.RUnlock()
+
+	s.Rounds = len(v.rnds)
+	for _, r := range v.rnds {
+		s.Size += r.size
+		s.Blocks += len(r.blks)
+	}
+	s.FreeBlocks = len(v.free)
+	s.Used = int64(s.Blocks-s.FreeBlocks) * int64(v.BlockSize)
+	return
+}
+
+// Sync flushes all rounds to disk.
+func (v *Volume) Sync() (err error) {
+	v.l.RLock()
+	defer v.l.RUnlock()
+
+	for _, r := range v.rnds {
+		err = r.Sync()
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
 // alloc returns a block, will create new round if is full for current rounds.
 func (v *Volume) alloc(fd uint32, idx, cap int32) (b *block, err error) {
 	v.l.Lock() // FIXME too big lock ?
 	defer v.l.Unlock()
 
+	if cap != v.BlockSize {
+		panic("invalid cap")
+	}
+
+	if n := len(v.free); n > 0 { // reuse released block first
+		b = v.free[n-1]
+		v.free = v.free[:n-1]
+		b.reset(fd, idx)
+		return
+	}
+
 	var r *round
 	n := len(v.rnds)
 	if n == 0 || v.rnds[n-1].Full() {
@@ -166,9 +232,16 @@ func (v *Volume) alloc(fd uint32, idx, cap int32) (b *block, err error) {
 		r = v.rnds[n-1]
 	}
 
-	if cap != v.BlockSize {
-		panic("invalid cap")
-	}
-
 	return r.Alloc(fd, idx, cap)
 }
+
+// release marks blocks as free, they will be reused by later alloc.
+func (v *Volume) release(blks []*block) {
+	v.l.Lock()
+	defer v.l.Unlock()
+
+	for _, b := range blks {
+		b.flag |= blockFree
+		v.free = append(v.free, b)
+	}
+}
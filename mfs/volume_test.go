@@ -54,6 +54,11 @@ func TestVolume(t *testing.T) {
 	require.Equal(t, []byte{'2', '3', '4', 0}, b0)
 	require.Equal(t, 3, n)
 
+	// read after the end in last block
+	n, err = f0.ReadAt(b0, 100)
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, 0, n)
+
 	// write between blocks
 	n, err = f0.WriteAt([]byte("abcd"), 1022)
 	require.NoError(t, err)
@@ -128,6 +133,12 @@ func TestVolume(t *testing.T) {
 	require.Equal(t, 4, n)
 	require.Equal(t, []byte("qwer"), b0)
 
+	// flush to disk
+	err = f10.Sync()
+	require.NoError(t, err)
+	err = v.Sync()
+	require.NoError(t, err)
+
 	// open new volume to read
 	v1, err := Open(dir, cfg)
 	require.NoError(t, err)
@@ -182,3 +193,123 @@ func TestVolumeConcurrent(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+func TestVolumeDiscard(t *testing.T) {
+	dir, err := ioutil.TempDir("", "volume")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := &Config{RoundSize: 4 << 10, BlockSize: 1 << 10}
+
+	t.Log(dir)
+
+	v, err := Open(dir, cfg)
+	require.NoError(t, err)
+
+	f0, err := v.Open(0)
+	require.NoError(t, err)
+
+	// fill a whole round
+	b0 := make([]byte, 4<<10)
+	for i := range b0 {
+		b0[i] = 'a'
+	}
+	n, err := f0.WriteAt(b0, 0)
+	require.NoError(t, err)
+	require.Equal(t, 4<<10, n)
+	require.Equal(t, 1, len(v.rnds))
+
+	// only whole blocks are released
+	f0.Discard(100, 2<<10)
+	require.Equal(t, 1, len(v.free))
+	require.Equal(t, Stat{Rounds: 1, Size: v.rnds[0].size, Blocks: 4, FreeBlocks: 1, Used: 3 << 10}, v.Stat())
+
+	b0 = make([]byte, 4)
+	n, err = f0.ReadAt(b0, 1<<10)
+	require.NoError(t, err)
+	require.Equal(t, 4, n)
+	require.Equal(t, []byte{0, 0, 0, 0}, b0)
+
+	n, err = f0.ReadAt(b0, 2<<10)
+	require.NoError(t, err)
+	require.Equal(t, []byte("aaaa"), b0)
+
+	// reuse the released block, no new round
+	f1, err := v.Open(1)
+	require.NoError(t, err)
+	n, err = f1.WriteAt([]byte("xyz"), 0)
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+	require.Equal(t, 1, len(v.rnds))
+	require.Equal(t, 0, len(v.free))
+
+	f0.Discard(0, 4<<10)
+	require.Equal(t, 3, len(v.free))
+
+	// released blocks are still free after reopen
+	v.Close()
+	v, err = Open(dir, cfg)
+	require.NoError(t, err)
+	defer v.Close()
+
+	require.Equal(t, 3, len(v.free))
+
+	f1, err = v.Open(1)
+	require.NoError(t, err)
+	b0 = make([]byte, 3)
+	n, err = f1.ReadAt(b0, 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("xyz"), b0)
+
+	f0, err = v.Open(0)
+	require.NoError(t, err)
+	n, err = f0.WriteAt([]byte("1234"), 4<<10)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(v.rnds))
+	require.Equal(t, 2, len(v.free))
+
+	b0 = make([]byte, 4)
+	n, err = f0.ReadAt(b0, 4<<10)
+	require.NoError(t, err)
+	require.Equal(t, []byte("1234"), b0)
+
+	// remove the whole file
+	v.Remove(0)
+	require.Equal(t, 3, len(v.free))
+	require.Equal(t, 1, len(v.Files()))
+}
+
+func TestVolumeDiscardTail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "volume")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	v, err := Open(dir, &Config{RoundSize: 4 << 10, BlockSize: 1 << 10})
+	require.NoError(t, err)
+	defer v.Close()
+
+	f0, err := v.Open(0)
+	require.NoError(t, err)
+
+	_, err = f0.WriteAt(make([]byte, 2<<10), 0)
+	require.NoError(t, err)
+
+	// the tail block becomes a file hole, writing after it allocates a new one
+	f0.Discard(0, 2<<10)
+	n, err := f0.WriteAt([]byte("1234"), 2<<10)
+	require.NoError(t, err)
+	require.Equal(t, 4, n)
+
+	b0 := make([]byte, 4)
+	_, err = f0.ReadAt(b0, 2<<10)
+	require.NoError(t, err)
+	require.Equal(t, []byte("1234"), b0)
+
+	_, err = f0.ReadAt(b0, 1<<10)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0, 0, 0, 0}, b0)
+
+	// holes are skipped
+	err = f0.SyncRange(1<<10-2, 1<<10+6)
+	require.NoError(t, err)
+}
@@ -2,26 +2,58 @@ package mmq
 
 import (
 	"errors"
+	"log"
 	"sync"
+	"time"
 )
 
 var (
 	// ErrOutOfTopic indicates can not create topics anymore.
 	ErrOutOfTopic = errors.New("out of topic")
+
+	// ErrFullQueue indicates messages of all topics exceed the memory cap of queue.
+	ErrFullQueue = errors.New("full queue")
+
+	// ErrClosedQueue indicates the queue is closed while waiting for room.
+	ErrClosedQueue = errors.New("closed queue")
+)
+
+// Overflow decides what Put does if a topic or the queue is full.
+type Overflow int
+
+const (
+	// OverflowReject returns ErrFullTopic or ErrFullQueue.
+	OverflowReject Overflow = iota
+
+	// OverflowDropOldest drops the oldest messages of the same topic until the message fits,
+	// returns ErrFullQueue if the topic is empty but the queue is still full.
+	OverflowDropOldest
+
+	// OverflowBlock waits until messages are dropped, the topic or the queue is closed.
+	OverflowBlock
 )
 
 // Config the message queue.
+//
+// The memory size of messages is the length of their data.
 type Config struct {
-	QueueCap int // max num of topics a queue can hold
-	TopicCap int // max memory size of messages a topic can hold
-	MsgCap   int // max length of a message
+	QueueCap  int      // max num of topics a queue can hold
+	TopicCap  int      // max memory size of messages a topic can hold
+	MsgCap    int      // max length of a message
+	MemoryCap int64    // max memory size of messages all topics can hold, 0 means no limit
+	Overflow  Overflow // what to do if TopicCap or MemoryCap is exceeded
+
+	SnapshotPath     string        // snapshot the queue to this file periodically and on Close, empty to disable
+	SnapshotInterval time.Duration // snapshot interval, 0 to snapshot on Close only
 }
 
-// DefaultConfig use up to 16GB memory with max 8000 topics, 2MB per topic, 1KB per message.
+// DefaultConfig use up to 16GB memory with max 8000 topics, 2MB per topic, 1KB per message,
+// and rejects messages if full.
 var DefaultConfig = &Config{
-	QueueCap: 8000,
-	TopicCap: 2 << 20, // 2MB
-	MsgCap:   1 << 10, // 1KB
+	QueueCap:  8000,
+	TopicCap:  2 << 20,  // 2MB
+	MsgCap:    1 << 10,  // 1KB
+	MemoryCap: 16 << 30, // 16GB
 }
 
 // Queue can have many topics, all messages are kept in memory.
@@ -29,14 +61,68 @@ type Queue struct {
 	*Config
 	topics map[string]*Topic
 	l      sync.RWMutex
+
+	used int64         // memory size of messages in all topics
+	room chan struct{} // closed if memory is released, created by waiters
+	ml   sync.Mutex    // protects used and room
+
+	sl   sync.Mutex // serializes SnapshotFile
+	done chan struct{}
+	wg   sync.WaitGroup // waits snapshotLoop
+	once sync.Once
 }
 
 // NewQueue create a message queue in memory.
 func NewQueue(cfg *Config) (q *Queue, err error) {
+	q = newQueue(cfg)
+	q.start()
+	return
+}
+
+func newQueue(cfg *Config) *Queue {
 	if cfg == nil {
 		cfg = DefaultConfig
 	}
-	q = &Queue{Config: cfg, topics: make(map[string]*Topic)}
+	return &Queue{Config: cfg, topics: make(map[string]*Topic), done: make(chan struct{})}
+}
+
+// start snapshots the queue periodically if configured.
+func (q *Queue) start() {
+	if q.SnapshotPath != "" && q.SnapshotInterval > 0 {
+		q.wg.Add(1)
+		go q.snapshotLoop(q.SnapshotPath, q.SnapshotInterval)
+	}
+}
+
+func (q *Queue) snapshotLoop(path string, interval time.Duration) {
+	defer q.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := q.SnapshotFile(path); err != nil {
+				log.Println("mmq: snapshot failed:", err)
+			}
+		case <-q.done:
+			return
+		}
+	}
+}
+
+// Close stops the periodic snapshot, and snapshots the queue the last time if SnapshotPath is set.
+// Puts waiting for room return ErrClosedQueue and will not wait anymore.
+// The queue is still usable but will not be snapshotted anymore, closing again does nothing.
+func (q *Queue) Close() (err error) {
+	q.once.Do(func() {
+		close(q.done)
+		q.wg.Wait()
+		if q.SnapshotPath != "" {
+			err = q.SnapshotFile(q.SnapshotPath)
+		}
+	})
 	return
 }
 
@@ -69,7 +155,7 @@ func (q *Queue) Get(id string) (t *Topic, err error) {
 		return
 	}
 
-	if len(q.topics) >= q.TopicCap {
+	if len(q.topics) >= q.QueueCap {
 		err = ErrOutOfTopic
 		return
 	}
@@ -82,3 +168,39 @@ func (q *Queue) Get(id string) (t *Topic, err error) {
 	q.topics[id] = t
 	return
 }
+
+// Used returns the memory size of messages in all topics.
+func (q *Queue) Used() int64 {
+	q.ml.Lock()
+	defer q.ml.Unlock()
+
+	return q.used
+}
+
+// reserve accounts n bytes to the queue if they fit in MemoryCap, otherwise returns
+// a channel closed once memory is released.
+func (q *Queue) reserve(n int) (room chan struct{}) {
+	q.ml.Lock()
+	defer q.ml.Unlock()
+
+	if q.MemoryCap > 0 && q.used+int64(n) > q.MemoryCap {
+		if q.room == nil {
+			q.room = make(chan struct{})
+		}
+		return q.room
+	}
+	q.used += int64(n)
+	return
+}
+
+// release returns n bytes to the queue and wakes waiters.
+func (q *Queue) release(n int) {
+	q.ml.Lock()
+	defer q.ml.Unlock()
+
+	q.used -= int64(n)
+	if q.room != nil {
+		close(q.room)
+		q.room = nil
+	}
+}
@@ -1,10 +1,17 @@
 package mmq
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -25,12 +32,14 @@ func TestMQ(t *testing.T) {
 	m := NewMessage([]byte("abcd"))
 	err = topic.Put(m)
 	require.NoError(t, err)
+	require.Equal(t, uint64(0), m.ID())
 	require.Equal(t, 1, topic.Pending())
 	require.Equal(t, 1, topic.Count())
 
 	m1, err := topic.Get()
 	require.NoError(t, err)
-	require.Equal(t, m, m1)
+	require.Equal(t, uint64(1), m1.ID())
+	require.Equal(t, m.Data(), m1.Data())
 	require.Equal(t, 0, topic.Pending())
 	require.Equal(t, 1, topic.Count())
 
@@ -43,29 +52,65 @@ func TestMQ(t *testing.T) {
 
 	m1, err = topic.Peek()
 	require.NoError(t, err)
-	require.Equal(t, m, m1)
+	require.Equal(t, uint64(2), m1.ID())
+	require.Equal(t, m.Data(), m1.Data())
 
-	m1, err = topic.Peek()
+	m2, err := topic.Peek()
 	require.NoError(t, err)
-	require.Equal(t, m, m1)
+	require.Equal(t, m1.ID(), m2.ID())
+	require.NotEqual(t, m1.Receipt(), m2.Receipt())
 
 	err = topic.Close()
 	require.NoError(t, err)
 
 	m1, err = topic.Peek()
 	require.NoError(t, err)
-	require.Equal(t, m, m1)
+	require.Equal(t, m.Data(), m1.Data())
 
 	err = topic.Put(m)
 	require.Equal(t, ErrClosedTopic, err)
 
-	err = topic.Drop(m)
+	err = topic.Drop(m2.Receipt())
+	require.Equal(t, ErrInvalidReceipt, err)
+	err = topic.Drop(m.Receipt())
+	require.Equal(t, ErrInvalidReceipt, err)
+
+	err = topic.Drop(m1.Receipt())
 	require.NoError(t, err)
 
-	err = topic.Drop(m)
+	err = topic.Drop(m1.Receipt())
 	require.Equal(t, ErrClosedTopic, err)
 }
 
+func TestMQSameData(t *testing.T) {
+	mq, err := NewQueue(nil)
+	require.NoError(t, err)
+
+	topic, err := mq.Get("0")
+	require.NoError(t, err)
+
+	m := NewMessage([]byte("abcd"))
+	require.NoError(t, topic.Put(m))
+	require.NoError(t, topic.Put(m))
+	require.Equal(t, uint64(0), m.ID())
+
+	m1, err := topic.Peek()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), m1.ID())
+	require.Equal(t, m.Checksum(), m1.Checksum())
+	require.NoError(t, topic.Drop(m1.Receipt()))
+
+	// a stale drop can not remove the other copy
+	require.Equal(t, ErrInvalidReceipt, topic.Drop(m1.Receipt()))
+	require.Equal(t, 1, topic.Pending())
+
+	m2, err := topic.Peek()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), m2.ID())
+	require.NoError(t, topic.Drop(m2.Receipt()))
+	require.Equal(t, 0, topic.Pending())
+}
+
 func TestMQParallel(t *testing.T) {
 	mq, err := NewQueue(nil)
 	require.NoError(t, err)
@@ -102,3 +147,260 @@ func TestMQParallel(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestMQCap(t *testing.T) {
+	mq, err := NewQueue(&Config{QueueCap: 2, TopicCap: 8, MsgCap: 4, MemoryCap: 12})
+	require.NoError(t, err)
+
+	t0, err := mq.Get("0")
+	require.NoError(t, err)
+	t1, err := mq.Get("1")
+	require.NoError(t, err)
+	_, err = mq.Get("2")
+	require.Equal(t, ErrOutOfTopic, err)
+
+	err = t0.Put(NewMessage([]byte("12345")))
+	require.Equal(t, ErrTooLargeMsg, err)
+
+	require.NoError(t, t0.Put(NewMessage([]byte("1234"))))
+	require.NoError(t, t0.Put(NewMessage([]byte("5678"))))
+	require.Equal(t, ErrFullTopic, t0.Put(NewMessage([]byte("a"))))
+	require.Equal(t, 8, t0.Size())
+
+	require.NoError(t, t1.Put(NewMessage([]byte("abc"))))
+	require.NoError(t, t1.Put(NewMessage([]byte("d"))))
+	require.Equal(t, ErrFullQueue, t1.Put(NewMessage([]byte("e"))))
+	require.Equal(t, int64(12), mq.Used())
+
+	m, err := t0.Get()
+	require.NoError(t, err)
+	require.Equal(t, []byte("1234"), m.Data())
+	require.Equal(t, int64(8), mq.Used())
+	require.NoError(t, t1.Put(NewMessage([]byte("e"))))
+	require.Equal(t, 5, t1.Size())
+	require.Equal(t, int64(9), mq.Used())
+}
+
+func TestMQOverflowDropOldest(t *testing.T) {
+	mq, err := NewQueue(&Config{QueueCap: 2, TopicCap: 8, MsgCap: 4, MemoryCap: 10, Overflow: OverflowDropOldest})
+	require.NoError(t, err)
+
+	t0, err := mq.Get("0")
+	require.NoError(t, err)
+	t1, err := mq.Get("1")
+	require.NoError(t, err)
+
+	for _, s := range []string{"12", "34", "56", "78", "9"} {
+		require.NoError(t, t0.Put(NewMessage([]byte(s))))
+	}
+	require.Equal(t, 4, t0.Pending())
+	require.Equal(t, 7, t0.Size())
+	require.Equal(t, 5, t0.Count())
+
+	m, err := t0.Peek()
+	require.NoError(t, err)
+	require.Equal(t, []byte("34"), m.Data())
+
+	// only the oldest of the same topic are dropped
+	require.Equal(t, ErrFullQueue, t1.Put(NewMessage([]byte("abcd"))))
+	require.NoError(t, t1.Put(NewMessage([]byte("ab"))))
+	require.NoError(t, t1.Put(NewMessage([]byte("c"))))
+	require.NoError(t, t1.Put(NewMessage([]byte("d"))))
+	require.Equal(t, 2, t1.Pending())
+	require.Equal(t, 7, t0.Size())
+	require.Equal(t, int64(9), mq.Used())
+
+	m, err = t1.Get()
+	require.NoError(t, err)
+	require.Equal(t, []byte("c"), m.Data())
+}
+
+func TestMQOverflowBlock(t *testing.T) {
+	mq, err := NewQueue(&Config{QueueCap: 2, TopicCap: 4, MsgCap: 4, MemoryCap: 6, Overflow: OverflowBlock})
+	require.NoError(t, err)
+
+	t0, err := mq.Get("0")
+	require.NoError(t, err)
+	t1, err := mq.Get("1")
+	require.NoError(t, err)
+
+	require.NoError(t, t0.Put(NewMessage([]byte("1234"))))
+	require.NoError(t, t1.Put(NewMessage([]byte("ab"))))
+
+	// blocked by the topic cap
+	done := make(chan error)
+	go func() { done <- t0.Put(NewMessage([]byte("5"))) }()
+	select {
+	case <-done:
+		t.Fatal("put should block")
+	case <-time.After(20 * time.Millisecond):
+	}
+	m, err := t0.Get()
+	require.NoError(t, err)
+	require.Equal(t, []byte("1234"), m.Data())
+	require.NoError(t, <-done)
+
+	// blocked by the queue cap
+	require.NoError(t, t1.Put(NewMessage([]byte("cd"))))
+	go func() { done <- t0.Put(NewMessage([]byte("67"))) }()
+	select {
+	case <-done:
+		t.Fatal("put should block")
+	case <-time.After(20 * time.Millisecond):
+	}
+	m, err = t1.Get()
+	require.NoError(t, err)
+	require.Equal(t, []byte("ab"), m.Data())
+	require.NoError(t, <-done)
+	require.Equal(t, int64(5), mq.Used())
+
+	// woken by close
+	go func() { done <- t0.Put(NewMessage([]byte("89"))) }()
+	select {
+	case <-done:
+		t.Fatal("put should block")
+	case <-time.After(20 * time.Millisecond):
+	}
+	require.NoError(t, t0.Close())
+	require.Equal(t, ErrClosedTopic, <-done)
+	require.Equal(t, 2, t0.Pending())
+
+	// canceled by ctx
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, t1.PutContext(ctx, NewMessage([]byte("efgh"))))
+
+	// woken by queue close
+	go func() { done <- t1.Put(NewMessage([]byte("efgh"))) }()
+	select {
+	case <-done:
+		t.Fatal("put should block")
+	case <-time.After(20 * time.Millisecond):
+	}
+	require.NoError(t, mq.Close())
+	require.Equal(t, ErrClosedQueue, <-done)
+	require.Equal(t, ErrClosedQueue, t1.Put(NewMessage([]byte("efgh"))))
+	require.Equal(t, 1, t1.Pending())
+}
+
+func TestMQSnapshot(t *testing.T) {
+	mq, err := NewQueue(nil)
+	require.NoError(t, err)
+
+	t0, err := mq.Get("0")
+	require.NoError(t, err)
+	for _, s := range []string{"a", "bc", "def"} {
+		require.NoError(t, t0.Put(NewMessage([]byte(s))))
+	}
+	_, err = t0.Get()
+	require.NoError(t, err)
+
+	t1, err := mq.Get("1")
+	require.NoError(t, err)
+	require.NoError(t, t1.Put(NewMessage([]byte("x"))))
+	require.NoError(t, t1.Close())
+
+	_, err = mq.Get("2")
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, mq.Snapshot(&buf))
+	b := buf.Bytes()
+
+	mq, err = Restore(bytes.NewReader(b), nil)
+	require.NoError(t, err)
+	require.Len(t, mq.Topics(), 3)
+	require.Equal(t, int64(6), mq.Used())
+
+	t0, err = mq.Get("0")
+	require.NoError(t, err)
+	require.Equal(t, 3, t0.Count())
+	require.Equal(t, 2, t0.Pending())
+	require.Equal(t, 5, t0.Size())
+	m, err := t0.Get()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), m.ID())
+	require.Equal(t, crc32.ChecksumIEEE([]byte("bc")), m.Checksum())
+	require.Equal(t, []byte("bc"), m.Data())
+
+	require.NoError(t, t0.Put(NewMessage([]byte("g"))))
+	for _, id := range []uint64{3, 4} {
+		m, err = t0.Get()
+		require.NoError(t, err)
+		require.Equal(t, id, m.ID())
+	}
+
+	t1, err = mq.Get("1")
+	require.NoError(t, err)
+	require.Equal(t, ErrClosedTopic, t1.Put(NewMessage([]byte("y"))))
+	m, err = t1.Get()
+	require.NoError(t, err)
+	require.Equal(t, []byte("x"), m.Data())
+
+	// caps are checked
+	_, err = Restore(bytes.NewReader(b), &Config{QueueCap: 2, TopicCap: 8, MsgCap: 4})
+	require.Equal(t, ErrOutOfTopic, err)
+	_, err = Restore(bytes.NewReader(b), &Config{QueueCap: 3, TopicCap: 4, MsgCap: 4})
+	require.Equal(t, ErrFullTopic, err)
+	_, err = Restore(bytes.NewReader(b), &Config{QueueCap: 3, TopicCap: 8, MsgCap: 4, MemoryCap: 5})
+	require.Equal(t, ErrFullQueue, err)
+
+	// broken snapshots
+	_, err = Restore(bytes.NewReader(b[:len(b)-1]), nil)
+	require.Equal(t, io.ErrUnexpectedEOF, err)
+
+	c := append([]byte(nil), b...)
+	c[0]++
+	_, err = Restore(bytes.NewReader(c), nil)
+	require.Equal(t, ErrInvalidSnapshot, err)
+
+	c = append([]byte(nil), b...)
+	c[bytes.Index(c, []byte("def"))]++
+	_, err = Restore(bytes.NewReader(c), nil)
+	require.Equal(t, ErrBrokenSnapshot, err)
+}
+
+func TestMQSnapshotFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fhck-mmq")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := *DefaultConfig
+	cfg.SnapshotPath = filepath.Join(dir, "snapshot")
+	cfg.SnapshotInterval = 10 * time.Millisecond
+
+	mq, err := RestoreFile(cfg.SnapshotPath, &cfg)
+	require.NoError(t, err)
+	require.Len(t, mq.Topics(), 0)
+
+	topic, err := mq.Get("0")
+	require.NoError(t, err)
+	require.NoError(t, topic.Put(NewMessage([]byte("a"))))
+
+	// periodic snapshot
+	for i := 0; ; i++ {
+		q, err := RestoreFile(cfg.SnapshotPath, nil)
+		require.NoError(t, err)
+		if len(q.Topics()) == 1 {
+			break
+		}
+		require.True(t, i < 100, "no snapshot")
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	require.NoError(t, topic.Put(NewMessage([]byte("b"))))
+	require.NoError(t, mq.Close())
+	require.NoError(t, mq.Close())
+	_, err = os.Stat(cfg.SnapshotPath + ".tmp")
+	require.True(t, os.IsNotExist(err))
+
+	cfg.SnapshotInterval = 0
+	mq, err = RestoreFile(cfg.SnapshotPath, &cfg)
+	require.NoError(t, err)
+	topic, err = mq.Get("0")
+	require.NoError(t, err)
+	require.Equal(t, 2, topic.Pending())
+	m, err := topic.Get()
+	require.NoError(t, err)
+	require.Equal(t, []byte("a"), m.Data())
+}
@@ -2,22 +2,41 @@ package mmq
 
 import "hash/crc32"
 
+// Receipt identifies exactly one delivery of a message by Peek.
+type Receipt struct {
+	id    uint64
+	token uint64
+}
+
 // Message can be put to or get from a topic.
 type Message struct {
-	id   uint32
-	data []byte
+	id      uint64
+	crc     uint32
+	data    []byte
+	receipt Receipt
 }
 
 // NewMessage create a message
 func NewMessage(b []byte) *Message {
-	return &Message{id: crc32.ChecksumIEEE(b), data: b}
+	return &Message{crc: crc32.ChecksumIEEE(b), data: b}
 }
 
-// ID returns the crc32 of message.
-func (m *Message) ID() uint32 {
+// ID returns the sequence of message in its topic from 1, it's assigned to the copy stored by Put,
+// so only messages returned by the topic have it.
+func (m *Message) ID() uint64 {
 	return m.id
 }
 
+// Checksum returns the crc32 of message.
+func (m *Message) Checksum() uint32 {
+	return m.crc
+}
+
+// Receipt returns the receipt of delivery if the message is returned by Peek.
+func (m *Message) Receipt() Receipt {
+	return m.receipt
+}
+
 // Data returns the real data.
 func (m *Message) Data() []byte {
 	return m.data
@@ -0,0 +1,67 @@
+package mmq
+
+const minRingSize = 16
+
+// ring is a FIFO of messages in a circular buffer. The buffer doubles when full and halves when
+// less than a quarter is used, slots are cleared once popped so messages can be collected.
+type ring struct {
+	buf  []*Message
+	head int // index of the first message
+	n    int // num of messages
+}
+
+func (r *ring) len() int {
+	return r.n
+}
+
+// at returns the i-th message from the first one.
+func (r *ring) at(i int) *Message {
+	return r.buf[(r.head+i)%len(r.buf)]
+}
+
+// front returns the first message, or nil if empty.
+func (r *ring) front() *Message {
+	if r.n == 0 {
+		return nil
+	}
+	return r.buf[r.head]
+}
+
+func (r *ring) push(m *Message) {
+	if r.n == len(r.buf) {
+		r.resize(2 * len(r.buf))
+	}
+	r.buf[(r.head+r.n)%len(r.buf)] = m
+	r.n++
+}
+
+// pop removes and returns the first message, or nil if empty.
+func (r *ring) pop() (m *Message) {
+	if r.n == 0 {
+		return
+	}
+	m = r.buf[r.head]
+	r.buf[r.head] = nil
+	r.head = (r.head + 1) % len(r.buf)
+	r.n--
+	if len(r.buf) > minRingSize && r.n < len(r.buf)/4 {
+		r.resize(len(r.buf) / 2)
+	}
+	return
+}
+
+func (r *ring) resize(size int) {
+	if size < minRingSize {
+		size = minRingSize
+	}
+	buf := make([]*Message, size)
+	end := r.head + r.n
+	if end <= len(r.buf) {
+		copy(buf, r.buf[r.head:end])
+	} else {
+		n := copy(buf, r.buf[r.head:])
+		copy(buf[n:], r.buf[:end-len(r.buf)])
+	}
+	r.buf = buf
+	r.head = 0
+}
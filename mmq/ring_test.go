@@ -0,0 +1,95 @@
+package mmq
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRing(t *testing.T) {
+	var r ring
+	require.Nil(t, r.front())
+	require.Nil(t, r.pop())
+
+	msgs := make([]*Message, 100)
+	for i := range msgs {
+		msgs[i] = NewMessage([]byte(fmt.Sprint(i)))
+	}
+
+	// wrap around without growing
+	for i := 0; i < 40; i++ {
+		r.push(msgs[i])
+		require.Equal(t, msgs[i], r.pop())
+	}
+	require.Equal(t, minRingSize, len(r.buf))
+
+	// grow while wrapped
+	for i := 0; i < 100; i++ {
+		r.push(msgs[i])
+	}
+	require.Equal(t, 100, r.len())
+	require.Equal(t, 128, len(r.buf))
+
+	for i := 0; i < 100; i++ {
+		require.Equal(t, msgs[i], r.front())
+		require.Equal(t, msgs[i], r.pop())
+	}
+	require.Equal(t, 0, r.len())
+	require.Equal(t, minRingSize, len(r.buf))
+	for _, m := range r.buf {
+		require.Nil(t, m)
+	}
+}
+
+// heapInuse returns the heap in use after a full GC.
+func heapInuse() uint64 {
+	var ms runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&ms)
+	return ms.HeapInuse
+}
+
+// BenchmarkTopicPutGet puts and gets messages one by one.
+func BenchmarkTopicPutGet(b *testing.B) {
+	q, err := NewQueue(nil)
+	require.NoError(b, err)
+	topic, err := q.Get("0")
+	require.NoError(b, err)
+
+	m := NewMessage(make([]byte, 128))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		require.NoError(b, topic.Put(m))
+		_, err = topic.Get()
+		require.NoError(b, err)
+	}
+}
+
+// BenchmarkTopicSoak keeps a backlog of messages in a topic during a long put/get soak,
+// heap-B must not grow with b.N.
+func BenchmarkTopicSoak(b *testing.B) {
+	const backlog = 1000
+
+	q, err := NewQueue(nil)
+	require.NoError(b, err)
+	topic, err := q.Get("0")
+	require.NoError(b, err)
+
+	for i := 0; i < backlog; i++ {
+		require.NoError(b, topic.Put(NewMessage(make([]byte, 1<<10))))
+	}
+
+	before := heapInuse()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		require.NoError(b, topic.Put(NewMessage(make([]byte, 1<<10))))
+		_, err = topic.Get()
+		require.NoError(b, err)
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(heapInuse())-float64(before), "heap-B")
+}
@@ -0,0 +1,304 @@
+package mmq
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Snapshot format, all integers are little endian:
+//
+//	| magic 4B | version 4B | topics 4B | topic ... | crc 4B |
+//
+// topic:
+//
+//	| id len 2B | id | cnt 8B | closed 1B | msgs 4B | msg ... |
+//
+// msg:
+//
+//	| id 8B | crc 4B | len 4B | data |
+//
+// The last crc is the crc32 of all bytes before it.
+const snapshotVersion = 1
+
+var (
+	snapshotMagic = binary.LittleEndian.Uint32([]byte("mmqs"))
+)
+
+var (
+	// ErrInvalidSnapshot indicates the magic number or version of snapshot mismatch.
+	ErrInvalidSnapshot = errors.New("invalid snapshot")
+
+	// ErrBrokenSnapshot indicates the checksum of snapshot mismatch.
+	ErrBrokenSnapshot = errors.New("broken snapshot")
+)
+
+// topicSnapshot is the state of a topic at one time.
+type topicSnapshot struct {
+	id     string
+	cnt    int
+	closed bool
+	msgs   []*Message
+}
+
+func (t *Topic) snapshot() (s topicSnapshot) {
+	t.l.RLock()
+	defer t.l.RUnlock()
+
+	s = topicSnapshot{id: t.id, cnt: t.cnt, closed: t.closed, msgs: make([]*Message, t.msgs.len())}
+	for i := range s.msgs {
+		s.msgs[i] = t.msgs.at(i)
+	}
+	return
+}
+
+// snapshotWriter writes integers and checksums all bytes written.
+type snapshotWriter struct {
+	w   *bufio.Writer
+	crc hash.Hash32
+	buf [8]byte
+	err error
+}
+
+func (w *snapshotWriter) write(b []byte) {
+	if w.err != nil {
+		return
+	}
+	w.crc.Write(b)
+	_, w.err = w.w.Write(b)
+}
+
+func (w *snapshotWriter) uint8(v uint8) {
+	w.buf[0] = v
+	w.write(w.buf[:1])
+}
+
+func (w *snapshotWriter) uint16(v uint16) {
+	binary.LittleEndian.PutUint16(w.buf[:], v)
+	w.write(w.buf[:2])
+}
+
+func (w *snapshotWriter) uint32(v uint32) {
+	binary.LittleEndian.PutUint32(w.buf[:], v)
+	w.write(w.buf[:4])
+}
+
+func (w *snapshotWriter) uint64(v uint64) {
+	binary.LittleEndian.PutUint64(w.buf[:], v)
+	w.write(w.buf[:8])
+}
+
+// Snapshot writes all topics with their pending messages to w.
+// Each topic is snapshotted at one time, but not all topics at the same time.
+func (q *Queue) Snapshot(w io.Writer) (err error) {
+	q.l.RLock()
+	topics := make([]*Topic, 0, len(q.topics))
+	for _, t := range q.topics {
+		topics = append(topics, t)
+	}
+	q.l.RUnlock()
+
+	sort.Slice(topics, func(i, j int) bool { return topics[i].id < topics[j].id })
+
+	sw := &snapshotWriter{w: bufio.NewWriter(w), crc: crc32.NewIEEE()}
+	sw.uint32(snapshotMagic)
+	sw.uint32(snapshotVersion)
+	sw.uint32(uint32(len(topics)))
+
+	for _, t := range topics {
+		s := t.snapshot()
+		sw.uint16(uint16(len(s.id)))
+		sw.write([]byte(s.id))
+		sw.uint64(uint64(s.cnt))
+		if s.closed {
+			sw.uint8(1)
+		} else {
+			sw.uint8(0)
+		}
+		sw.uint32(uint32(len(s.msgs)))
+		for _, m := range s.msgs {
+			sw.uint64(m.id)
+			sw.uint32(m.crc)
+			sw.uint32(uint32(len(m.data)))
+			sw.write(m.data)
+		}
+	}
+
+	sw.uint32(sw.crc.Sum32())
+	if sw.err != nil {
+		return sw.err
+	}
+	return sw.w.Flush()
+}
+
+// SnapshotFile writes the snapshot to a temporary file, and renames it to path.
+// The file at path is either the old snapshot or the new one even if the machine crashes.
+// Calls are serialized, so they never write the same temporary file.
+func (q *Queue) SnapshotFile(path string) (err error) {
+	q.sl.Lock()
+	defer q.sl.Unlock()
+
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+		}
+	}()
+
+	err = q.Snapshot(f)
+	if err != nil {
+		return
+	}
+	err = f.Sync()
+	if err != nil {
+		return
+	}
+	err = f.Close()
+	if err != nil {
+		return
+	}
+	err = os.Rename(tmp, path)
+	if err != nil {
+		return
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir makes renames in dir durable.
+func syncDir(dir string) (err error) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// snapshotReader reads integers and checksums all bytes read.
+type snapshotReader struct {
+	r   *bufio.Reader
+	crc hash.Hash32
+	buf [8]byte
+	err error
+}
+
+func (r *snapshotReader) read(b []byte) {
+	if r.err != nil {
+		return
+	}
+	_, r.err = io.ReadFull(r.r, b)
+	if r.err == io.EOF {
+		r.err = io.ErrUnexpectedEOF
+	}
+	r.crc.Write(b)
+}
+
+func (r *snapshotReader) uint8() uint8 {
+	r.read(r.buf[:1])
+	return r.buf[0]
+}
+
+func (r *snapshotReader) uint16() uint16 {
+	r.read(r.buf[:2])
+	return binary.LittleEndian.Uint16(r.buf[:])
+}
+
+func (r *snapshotReader) uint32() uint32 {
+	r.read(r.buf[:4])
+	return binary.LittleEndian.Uint32(r.buf[:])
+}
+
+func (r *snapshotReader) uint64() uint64 {
+	r.read(r.buf[:8])
+	return binary.LittleEndian.Uint64(r.buf[:])
+}
+
+// Restore creates a queue from the snapshot in r. The caps of cfg are checked
+// as messages are put again.
+func Restore(r io.Reader, cfg *Config) (q *Queue, err error) {
+	q = newQueue(cfg)
+	sr := &snapshotReader{r: bufio.NewReader(r), crc: crc32.NewIEEE()}
+
+	if sr.uint32() != snapshotMagic || sr.uint32() != snapshotVersion {
+		if sr.err == nil {
+			sr.err = ErrInvalidSnapshot
+		}
+		return nil, sr.err
+	}
+
+	ntopic := int(sr.uint32())
+	if sr.err == nil && ntopic > q.QueueCap {
+		sr.err = ErrOutOfTopic
+	}
+	for i := 0; i < ntopic && sr.err == nil; i++ {
+		id := make([]byte, sr.uint16())
+		sr.read(id)
+		t, _ := newTopic(q, string(id))
+		t.cnt = int(sr.uint64())
+		t.closed = sr.uint8() != 0
+
+		nmsg := int(sr.uint32())
+		for j := 0; j < nmsg && sr.err == nil; j++ {
+			m := &Message{id: sr.uint64(), crc: sr.uint32()}
+			n := int(sr.uint32())
+			if sr.err != nil {
+				break
+			}
+			if n > q.MsgCap {
+				sr.err = ErrTooLargeMsg
+				break
+			}
+			m.data = make([]byte, n)
+			sr.read(m.data)
+
+			t.size += n
+			q.used += int64(n)
+			if t.size > q.TopicCap {
+				sr.err = ErrFullTopic
+			} else if q.MemoryCap > 0 && q.used > q.MemoryCap {
+				sr.err = ErrFullQueue
+			}
+			t.msgs.push(m)
+		}
+		q.topics[t.id] = t
+	}
+	if sr.err != nil {
+		return nil, sr.err
+	}
+
+	crc := sr.crc.Sum32()
+	if sr.uint32() != crc {
+		if sr.err == nil {
+			sr.err = ErrBrokenSnapshot
+		}
+		return nil, sr.err
+	}
+
+	q.start()
+	return
+}
+
+// RestoreFile creates a queue from the snapshot file at path, or an empty queue if path is not exist.
+func RestoreFile(path string, cfg *Config) (q *Queue, err error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return NewQueue(cfg)
+	}
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	return Restore(f, cfg)
+}
@@ -1,6 +1,7 @@
 package mmq
 
 import (
+	"context"
 	"errors"
 	"io"
 	"sync"
@@ -16,6 +17,9 @@ var (
 	// ErrInvalidMsg indicates an invalid message
 	ErrInvalidMsg = errors.New("invalid message")
 
+	// ErrInvalidReceipt indicates the receipt is not of the last delivery of the first message.
+	ErrInvalidReceipt = errors.New("invalid receipt")
+
 	// ErrTooLargeMsg indicates message length exceed the max cap.
 	ErrTooLargeMsg = errors.New("too large message")
 )
@@ -24,9 +28,13 @@ var (
 type Topic struct {
 	q      *Queue
 	id     string
-	msgs   []*Message
-	cnt    int // all messags received
+	msgs   ring
+	size   int     // memory size of pending messages
+	cnt    int     // all messags received, also the id of the last message
+	token  uint64  // deliveries by Peek
+	head   Receipt // receipt of the last delivery of the first message
 	closed bool
+	room   chan struct{} // closed if messages are dropped or topic is closed, created by waiters
 	l      sync.RWMutex
 }
 
@@ -53,7 +61,23 @@ func (t *Topic) Pending() int {
 	t.l.RLock()
 	defer t.l.RUnlock()
 
-	return len(t.msgs)
+	return t.msgs.len()
+}
+
+// Size returns the memory size of pending messages.
+func (t *Topic) Size() int {
+	t.l.RLock()
+	defer t.l.RUnlock()
+
+	return t.size
+}
+
+// wake wakes puts waiting for room.
+func (t *Topic) wake() {
+	if t.room != nil {
+		close(t.room)
+		t.room = nil
+	}
 }
 
 // Close marks this topic as closed. Message can not be put to this topic after closed,
@@ -63,11 +87,12 @@ func (t *Topic) Close() (err error) {
 	defer t.l.Unlock()
 
 	t.closed = true
+	t.wake()
 	return
 }
 
 func (t *Topic) peek() (m *Message, err error) {
-	if len(t.msgs) == 0 {
+	if t.msgs.len() == 0 {
 		if t.closed {
 			err = ErrClosedTopic
 		} else {
@@ -75,41 +100,51 @@ func (t *Topic) peek() (m *Message, err error) {
 		}
 		return
 	}
-	m = t.msgs[0]
+	m = t.msgs.front()
 	return
 }
 
 // Peek only returns the message, won't drop it.
+// Each Peek is a new delivery, only the receipt of the last one is able to drop the message.
 func (t *Topic) Peek() (m *Message, err error) {
-	t.l.RLock()
-	defer t.l.RUnlock()
-
-	return t.peek()
-}
+	t.l.Lock()
+	defer t.l.Unlock()
 
-func (t *Topic) drop(m *Message) (err error) {
-	if len(t.msgs) == 0 {
-		if t.closed {
-			err = ErrClosedTopic
-		} else {
-			err = io.EOF
-		}
-		return
-	}
-	if t.msgs[0].ID() != m.ID() {
-		err = ErrInvalidMsg
+	m, err = t.peek()
+	if err != nil {
 		return
 	}
-	t.msgs = t.msgs[1:]
+
+	t.token++
+	t.head = Receipt{id: m.id, token: t.token}
+	m = &Message{id: m.id, crc: m.crc, data: m.data, receipt: t.head}
 	return
 }
 
-// Drop should only be called after Peek and with the right message
-func (t *Topic) Drop(m *Message) error {
+// pop removes the first message.
+func (t *Topic) pop() {
+	m := t.msgs.pop()
+	t.head = Receipt{}
+	t.size -= len(m.Data())
+	t.q.release(len(m.Data()))
+	t.wake()
+}
+
+// Drop should only be called after Peek and with the receipt of the message.
+func (t *Topic) Drop(r Receipt) (err error) {
 	t.l.Lock()
 	defer t.l.Unlock()
 
-	return t.drop(m)
+	_, err = t.peek()
+	if err != nil {
+		return
+	}
+	if r.token == 0 || r != t.head {
+		err = ErrInvalidReceipt
+		return
+	}
+	t.pop()
+	return
 }
 
 // Get returns a message in topic and drop it.
@@ -122,13 +157,22 @@ func (t *Topic) Get() (m *Message, err error) {
 		return
 	}
 
-	err = t.drop(m)
+	t.pop()
 	return
 }
 
-// Put a message to this topic.
-func (t *Topic) Put(m *Message) (err error) {
-	if len(m.Data()) > t.q.MsgCap {
+// Put a copy of m to this topic with the next id of this topic, m is not changed.
+// If the topic or queue is full, the message is rejected, the oldest messages are dropped,
+// or Put waits according to Overflow.
+func (t *Topic) Put(m *Message) error {
+	return t.PutContext(context.Background(), m)
+}
+
+// PutContext puts a message like Put, but stops waiting for room if ctx is done,
+// ErrClosedQueue is returned if the queue is closed while waiting.
+func (t *Topic) PutContext(ctx context.Context, m *Message) (err error) {
+	n := len(m.Data())
+	if n > t.q.MsgCap || n > t.q.TopicCap || (t.q.MemoryCap > 0 && int64(n) > t.q.MemoryCap) {
 		err = ErrTooLargeMsg
 		return
 	}
@@ -136,17 +180,54 @@ func (t *Topic) Put(m *Message) (err error) {
 	t.l.Lock()
 	defer t.l.Unlock()
 
-	if t.closed {
-		err = ErrClosedTopic
-		return
-	}
+	for {
+		if t.closed {
+			err = ErrClosedTopic
+			return
+		}
 
-	if len(t.msgs) >= t.q.TopicCap {
-		err = ErrFullTopic
-		return
+		full, room := ErrFullTopic, chan struct{}(nil)
+		if t.size+n <= t.q.TopicCap {
+			room = t.q.reserve(n)
+			if room == nil {
+				break
+			}
+			full = ErrFullQueue
+		}
+
+		switch t.q.Overflow {
+		case OverflowDropOldest:
+			if t.msgs.len() == 0 {
+				err = full
+				return
+			}
+			t.pop()
+		case OverflowBlock:
+			if t.room == nil {
+				t.room = make(chan struct{})
+			}
+			troom := t.room
+			t.l.Unlock()
+			select {
+			case <-troom:
+			case <-room: // nil if only the topic is full
+			case <-t.q.done:
+				err = ErrClosedQueue
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+			t.l.Lock()
+			if err != nil {
+				return
+			}
+		default:
+			err = full
+			return
+		}
 	}
 
 	t.cnt++
-	t.msgs = append(t.msgs, m)
+	t.size += n
+	t.msgs.push(&Message{id: uint64(t.cnt), crc: m.crc, data: m.data})
 	return
 }
@@ -0,0 +1,120 @@
+package mq
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var (
+	// ErrInvalidDeadLetter indicates the dead letter topic is the topic itself, reserved,
+	// or closed or deleted when moving messages to it.
+	ErrInvalidDeadLetter = errors.New("invalid dead letter topic")
+)
+
+// DeadLetter moves messages received but not acked for MaxAttempts times to the dead letter Topic
+// of the same queue, zero MaxAttempts disables it.
+type DeadLetter struct {
+	Topic       uint32
+	MaxAttempts int
+}
+
+// DeadMessage is a message moved to a dead letter topic, saved as | topic 4B | attempts 4B | data |.
+type DeadMessage struct {
+	Topic    uint32 // original topic
+	Attempts int    // delivery attempts before moved
+	Data     []byte
+}
+
+// Bytes returns the message saved in dead letter topic.
+func (m *DeadMessage) Bytes() []byte {
+	b := make([]byte, 8+len(m.Data))
+	binary.LittleEndian.PutUint32(b, m.Topic)
+	binary.LittleEndian.PutUint32(b[4:], uint32(m.Attempts))
+	copy(b[8:], m.Data)
+	return b
+}
+
+// ParseDeadMessage parses a message got from a dead letter topic.
+func ParseDeadMessage(b []byte) (m *DeadMessage, err error) {
+	if len(b) < 8 {
+		err = ErrInvalidMsg
+		return
+	}
+	m = &DeadMessage{
+		Topic:    binary.LittleEndian.Uint32(b),
+		Attempts: int(binary.LittleEndian.Uint32(b[4:])),
+		Data:     b[8:],
+	}
+	return
+}
+
+// DeadLetter returns the dead letter config of this topic.
+func (t *Topic) DeadLetter() DeadLetter {
+	t.l.RLock()
+	defer t.l.RUnlock()
+
+	return DeadLetter{Topic: t.dead.Topic, MaxAttempts: int(t.dead.MaxAttempts)}
+}
+
+// SetDeadLetter saves the dead letter config of this topic, the dead letter topic can not be itself.
+func (t *Topic) SetDeadLetter(d DeadLetter) (err error) {
+	if d.MaxAttempts > 0 && (d.Topic == t.id || d.Topic >= reservedFd) {
+		err = ErrInvalidDeadLetter
+		return
+	}
+
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	f, err := t.file()
+	if err != nil {
+		return
+	}
+
+	di := &deadIndex{Topic: d.Topic, MaxAttempts: int64(d.MaxAttempts), Seq: t.dead.Seq + 1}
+	_, err = f.WriteAt(encodeSlot(di), deadOff+di.Seq%2*slotSize)
+	if err != nil {
+		return
+	}
+	t.dead = di
+	return
+}
+
+// deadLetter puts a message leased by Receive at head to the dead letter topic and drops it
+// from this group in one transaction. It's called without topic lock, because putting to
+// another topic may wait for this one. ErrInvalidDeadLetter is returned if the dead letter topic
+// is closed or deleted, the message stays at head until it's fixed.
+func (g *Group) deadLetter(m *Message) (err error) {
+	t := g.t
+	d := t.DeadLetter()
+	dt, ok := t.q.Find(d.Topic)
+	if !ok {
+		err = ErrInvalidDeadLetter
+		return
+	}
+
+	tx := t.q.Txn()
+	dm := &DeadMessage{Topic: t.id, Attempts: m.Attempts, Data: m.Data}
+	err = tx.Put(dt, dm.Bytes())
+	if err != nil {
+		return
+	}
+
+	t.l.RLock()
+	l, ok := g.leases[m.Receipt.off]
+	if !ok || l.token != m.Receipt.token || l.acked || l.off != g.off() { // dropped by others
+		t.l.RUnlock()
+		return
+	}
+	tx.gets = append(tx.gets, &txnOp{typ: opGet, t: t, g: g, l: l, off: l.off, noff: l.off + l.n, next: g.next() + 1})
+	t.l.RUnlock()
+
+	err = tx.Commit()
+	switch err {
+	case ErrTxnConflict: // dropped by others
+		err = nil
+	case ErrClosedTopic, ErrDeletedTopic:
+		err = ErrInvalidDeadLetter
+	}
+	return
+}
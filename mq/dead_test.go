@@ -0,0 +1,129 @@
+package mq
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeadLetter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fhck-mq")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mq, err := NewQueue(dir, nil)
+	require.NoError(t, err)
+
+	topic, err := mq.Get(0)
+	require.NoError(t, err)
+
+	err = topic.SetDeadLetter(DeadLetter{Topic: 0, MaxAttempts: 2})
+	require.Equal(t, ErrInvalidDeadLetter, err)
+
+	d := DeadLetter{Topic: 1, MaxAttempts: 2}
+	err = topic.SetDeadLetter(d)
+	require.NoError(t, err)
+	mq.Close()
+
+	// config is persisted
+	mq, err = NewQueue(dir, nil)
+	require.NoError(t, err)
+
+	topic, err = mq.Get(0)
+	require.NoError(t, err)
+	require.Equal(t, d, topic.DeadLetter())
+
+	for _, m := range []string{"a", "b"} {
+		err = topic.Put([]byte(m))
+		require.NoError(t, err)
+	}
+
+	for i := 1; i <= 2; i++ {
+		m, err := topic.Receive(time.Minute)
+		require.NoError(t, err)
+		require.Equal(t, []byte("a"), m.Data)
+		require.Equal(t, i, m.Attempts)
+		err = topic.Nack(m.Receipt)
+		require.NoError(t, err)
+	}
+
+	// dead letter topic is not created
+	_, err = topic.Receive(time.Minute)
+	require.Equal(t, ErrInvalidDeadLetter, err)
+	mq.Close()
+
+	// attempts of head are persisted
+	mq, err = NewQueue(dir, nil)
+	require.NoError(t, err)
+	defer mq.Close()
+
+	topic, err = mq.Get(0)
+	require.NoError(t, err)
+	dt, err := mq.Get(1)
+	require.NoError(t, err)
+
+	// moved to dead letter topic after max attempts
+	m, err := topic.Receive(time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, []byte("b"), m.Data)
+	require.Equal(t, 1, m.Attempts)
+	err = topic.Ack(m.Receipt)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), topic.Pending())
+
+	// moved after messages before it are acked
+	for _, m := range []string{"c", "d"} {
+		err = topic.Put([]byte(m))
+		require.NoError(t, err)
+	}
+	c, err := topic.Receive(time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, []byte("c"), c.Data)
+	for i := 1; i <= 2; i++ {
+		m, err := topic.Receive(time.Minute)
+		require.NoError(t, err)
+		require.Equal(t, []byte("d"), m.Data)
+		err = topic.Nack(m.Receipt)
+		require.NoError(t, err)
+	}
+	_, err = topic.Receive(time.Minute)
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, int64(2), topic.Pending())
+	err = topic.Ack(c.Receipt)
+	require.NoError(t, err)
+	_, err = topic.Receive(time.Minute)
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, int64(0), topic.Pending())
+
+	for _, data := range []string{"a", "d"} {
+		b, err := dt.Get()
+		require.NoError(t, err)
+		dm, err := ParseDeadMessage(b)
+		require.NoError(t, err)
+		require.Equal(t, &DeadMessage{Topic: 0, Attempts: 2, Data: []byte(data)}, dm)
+	}
+	_, err = dt.Get()
+	require.Equal(t, io.EOF, err)
+
+	// closed dead letter topic
+	err = topic.Put([]byte("e"))
+	require.NoError(t, err)
+	for i := 1; i <= 2; i++ {
+		m, err := topic.Receive(time.Minute)
+		require.NoError(t, err)
+		err = topic.Nack(m.Receipt)
+		require.NoError(t, err)
+	}
+	err = dt.Close()
+	require.NoError(t, err)
+	_, err = topic.Receive(time.Minute)
+	require.Equal(t, ErrInvalidDeadLetter, err)
+	require.Equal(t, int64(1), topic.Pending())
+
+	_, err = ParseDeadMessage([]byte("x"))
+	require.Equal(t, ErrInvalidMsg, err)
+}
@@ -0,0 +1,213 @@
+package mq
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"time"
+
+	"github.com/justmao945/tama/bloom"
+	"github.com/justmao945/tama/mfs"
+)
+
+// Dedup key layout on disk:
+//
+//	| crc 4B | time 8B | seq 8B | len 2B | key |
+//
+// Keys are appended in put order, seq is the message put with it. The end of keys is committed with
+// the messages in index, keys after it are not committed and overwritten by the next key.
+const (
+	dedupHeaderSize = 4 + 8 + 8 + 2
+	dedupGenKeys    = 1024 // keys in a generation
+	dedupBitsPerKey = 10
+)
+
+// MaxKeySize is the max length of a dedup key.
+const MaxKeySize = 256
+
+var (
+	// ErrDuplicateMsg indicates a message with the same key has been put within the dedup window.
+	ErrDuplicateMsg = errors.New("duplicate message")
+
+	// ErrInvalidKey indicates the dedup key is empty or too long.
+	ErrInvalidKey = errors.New("invalid key")
+)
+
+// dedupGen is a generation of keys saved in [start, end), checked by filter before reading them.
+type dedupGen struct {
+	filter     bloom.Filter
+	start, end int64
+	last       int64 // put time of the newest key
+}
+
+// dedup remembers keys put within window. Keys are sealed to a bloom filter every dedupGenKeys,
+// and a generation is dropped when all its keys are expired.
+type dedup struct {
+	gens  []*dedupGen
+	keys  map[string]int64 // keys of the current generation to put time
+	start int64            // start of the current generation
+	end   int64            // end of key log
+	last  int64
+	rec   int64 // blocks below this off have been released
+}
+
+func newDedup(off int64) *dedup {
+	return &dedup{keys: make(map[string]int64), start: off, end: off}
+}
+
+// loadDedup loads keys committed in [off, end) of the key log.
+func loadDedup(f *mfs.File, off, end int64) (d *dedup, err error) {
+	if off < dedupOff {
+		off = dedupOff
+	}
+	d = newDedup(off)
+	for d.end < end {
+		key, tm, _, n, err1 := readDedupKey(f, d.end)
+		if err1 != nil {
+			err = err1
+			return
+		}
+		d.add(key, tm, d.end+n)
+	}
+	return
+}
+
+func appendDedupKey(dst, key []byte, tm, seq int64) []byte {
+	start := len(dst)
+	dst = append(dst, make([]byte, dedupHeaderSize)...)
+	raw := dst[start:]
+	binary.LittleEndian.PutUint64(raw[4:], uint64(tm))
+	binary.LittleEndian.PutUint64(raw[12:], uint64(seq))
+	binary.LittleEndian.PutUint16(raw[20:], uint16(len(key)))
+	dst = append(dst, key...)
+	raw = dst[start:]
+	binary.LittleEndian.PutUint32(raw, crc32.ChecksumIEEE(raw[4:]))
+	return dst
+}
+
+func readDedupKey(f *mfs.File, off int64) (key []byte, tm, seq, n int64, err error) {
+	hdr := make([]byte, dedupHeaderSize)
+	_, err = f.ReadAt(hdr, off)
+	if err != nil {
+		return
+	}
+	n = dedupHeaderSize + int64(binary.LittleEndian.Uint16(hdr[20:]))
+	raw := make([]byte, n)
+	_, err = f.ReadAt(raw, off)
+	if err != nil {
+		return
+	}
+	if binary.LittleEndian.Uint32(raw) != crc32.ChecksumIEEE(raw[4:]) {
+		err = ErrBrokenIndex
+		return
+	}
+	tm = int64(binary.LittleEndian.Uint64(raw[4:]))
+	seq = int64(binary.LittleEndian.Uint64(raw[12:]))
+	key = raw[dedupHeaderSize:]
+	return
+}
+
+// add adds a key saved before end.
+func (d *dedup) add(key []byte, tm, end int64) {
+	d.keys[string(key)] = tm
+	d.end, d.last = end, tm
+	if len(d.keys) < dedupGenKeys {
+		return
+	}
+
+	keys := make([][]byte, 0, len(d.keys))
+	for k := range d.keys {
+		keys = append(keys, []byte(k))
+	}
+	g := &dedupGen{
+		filter: bloom.NewFilter(nil, keys, dedupBitsPerKey),
+		start:  d.start,
+		end:    d.end,
+		last:   d.last,
+	}
+	d.gens = append(d.gens, g)
+	d.keys = make(map[string]int64)
+	d.start = d.end
+}
+
+// expire drops generations put before deadline, returns start of the key log not expired.
+func (d *dedup) expire(deadline int64) int64 {
+	for len(d.gens) > 0 && d.gens[0].last < deadline {
+		d.gens = d.gens[1:]
+	}
+	if len(d.gens) > 0 {
+		return d.gens[0].start
+	}
+	return d.start
+}
+
+// seen returns true if key is put after deadline.
+func (d *dedup) seen(f *mfs.File, key []byte, deadline int64) (ok bool, err error) {
+	if tm, ok1 := d.keys[string(key)]; ok1 && tm >= deadline {
+		ok = true
+		return
+	}
+	for i := len(d.gens) - 1; i >= 0; i-- {
+		g := d.gens[i]
+		if g.last < deadline {
+			break
+		}
+		if !g.filter.MayContain(key) {
+			continue
+		}
+		for off := g.start; off < g.end; {
+			k, tm, _, n, err1 := readDedupKey(f, off)
+			if err1 != nil {
+				err = err1
+				return
+			}
+			if tm >= deadline && bytes.Equal(k, key) {
+				ok = true
+				return
+			}
+			off += n
+		}
+	}
+	return
+}
+
+// check expires keys out of window, returns ErrDuplicateMsg if key is seen in window,
+// start is the start of key log not expired.
+func (d *dedup) check(f *mfs.File, key []byte, now int64, window time.Duration) (start int64, err error) {
+	deadline := int64(0)
+	if window > 0 {
+		deadline = now - int64(window)
+	}
+	start = d.expire(deadline)
+
+	ok, err := d.seen(f, key, deadline)
+	if err != nil {
+		return
+	}
+	if ok {
+		err = ErrDuplicateMsg
+	}
+	return
+}
+
+// reclaim releases whole blocks of the key log before start.
+func (d *dedup) reclaim(f *mfs.File, start, blkSize int64) {
+	if d.rec < dedupOff {
+		d.rec = dedupOff
+	}
+	if start/blkSize <= d.rec/blkSize {
+		return
+	}
+	f.Discard(d.rec, start-d.rec)
+	d.rec = start / blkSize * blkSize
+}
+
+// PutWithKey puts a message unless a message with the same key has been put within the dedup
+// window of queue, ErrDuplicateMsg is returned in that case.
+func (t *Topic) PutWithKey(key, b []byte) error {
+	if len(key) == 0 || len(key) > MaxKeySize {
+		return ErrInvalidKey
+	}
+	return t.put([][]byte{b}, 0, key)
+}
@@ -0,0 +1,105 @@
+package mq
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDedup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fhck-mq")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mq, err := NewQueue(dir, nil)
+	require.NoError(t, err)
+
+	topic, err := mq.Get(0)
+	require.NoError(t, err)
+
+	err = topic.PutWithKey(nil, []byte("a"))
+	require.Equal(t, ErrInvalidKey, err)
+
+	const N = 3 * dedupGenKeys
+	for i := 0; i < N; i++ {
+		err = topic.PutWithKey([]byte(fmt.Sprint("k", i)), []byte(fmt.Sprint(i)))
+		require.NoError(t, err)
+	}
+	require.Equal(t, 3, len(topic.dedup.gens))
+
+	// keys in filters and the current generation
+	for _, i := range []int{0, dedupGenKeys + 1, N - 1} {
+		err = topic.PutWithKey([]byte(fmt.Sprint("k", i)), []byte("x"))
+		require.Equal(t, ErrDuplicateMsg, err)
+	}
+	require.Equal(t, int64(N), topic.Count())
+
+	// key saved but message not committed, then a message put without key
+	raw := appendDedupKey(nil, []byte("crash"), time.Now().UnixNano(), topic.idx.Count)
+	f, err := mq.vol.Open(0)
+	require.NoError(t, err)
+	_, err = f.WriteAt(raw, topic.dedup.end)
+	require.NoError(t, err)
+	mq.Close()
+
+	mq, err = NewQueue(dir, nil)
+	require.NoError(t, err)
+	topic, err = mq.Get(0)
+	require.NoError(t, err)
+	require.NoError(t, topic.Put([]byte("z")))
+	mq.Close()
+
+	// keys are persisted
+	mq, err = NewQueue(dir, nil)
+	require.NoError(t, err)
+	defer mq.Close()
+
+	topic, err = mq.Get(0)
+	require.NoError(t, err)
+	for _, i := range []int{0, dedupGenKeys + 1, N - 1} {
+		err = topic.PutWithKey([]byte(fmt.Sprint("k", i)), []byte("x"))
+		require.Equal(t, ErrDuplicateMsg, err)
+	}
+	err = topic.PutWithKey([]byte("crash"), []byte("y"))
+	require.NoError(t, err)
+	err = topic.PutWithKey([]byte("crash"), []byte("y"))
+	require.Equal(t, ErrDuplicateMsg, err)
+	require.Equal(t, int64(N+2), topic.Count())
+}
+
+func TestDedupWindow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fhck-mq")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mq, err := NewQueue(dir, &Config{Recover: true, DedupWindow: 10 * time.Millisecond})
+	require.NoError(t, err)
+	defer mq.Close()
+
+	topic, err := mq.Get(0)
+	require.NoError(t, err)
+
+	err = topic.PutWithKey([]byte("k"), []byte("a"))
+	require.NoError(t, err)
+	err = topic.PutWithKey([]byte("k"), []byte("a"))
+	require.Equal(t, ErrDuplicateMsg, err)
+
+	time.Sleep(20 * time.Millisecond)
+	err = topic.PutWithKey([]byte("k"), []byte("a"))
+	require.NoError(t, err)
+
+	// storage of expired keys is reclaimed
+	for i := 0; i < 20*dedupGenKeys; i++ {
+		err = topic.PutWithKey([]byte(fmt.Sprintf("key-%010d", i)), nil)
+		require.NoError(t, err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	err = topic.PutWithKey([]byte("k"), []byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, 0, len(topic.dedup.gens))
+	require.True(t, topic.dedup.rec > dedupOff)
+}
@@ -0,0 +1,155 @@
+package mq
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+)
+
+// Frame layout on disk:
+//
+//	legacy: | len 2B | data |
+//	v1:     | flags 4b, len 28b | crc 4B if frameCRC | time 8B if frameTime | deadline 8B if frameTTL | data |
+const (
+	legacyHeaderSize = 2
+	frameHeaderSize  = 4
+	frameLenBits     = 28
+	frameLenMask     = 1<<frameLenBits - 1
+)
+
+// frame flags
+const (
+	frameCRC   = 1 << iota   // crc32 of the whole frame except crc itself
+	frameTime                // unix nano when the message is put
+	frameTTL                 // unix nano when the message expires
+	frameFlags = 1<<iota - 1 // all known flags
+)
+
+// MaxMsgSize is the max length of a message can be put to a topic.
+const MaxMsgSize = frameLenMask
+
+// frame is a message read from topic, data is nil if only the header is read.
+type frame struct {
+	flags    uint32
+	len      int   // length of data
+	n        int64 // size of the whole frame
+	time     int64 // unix nano when put, 0 if unknown
+	deadline int64 // unix nano when expired, 0 if never
+	data     []byte
+}
+
+// frameSize returns the size of a v1 framed message on disk.
+func frameSize(flags uint32, len int) int64 {
+	n := int64(frameHeaderSize + len)
+	if flags&frameCRC != 0 {
+		n += 4
+	}
+	if flags&frameTime != 0 {
+		n += 8
+	}
+	if flags&frameTTL != 0 {
+		n += 8
+	}
+	return n
+}
+
+// appendFrame appends framed b to dst, deadline is 0 if b never expires.
+func appendFrame(dst, b []byte, time, deadline int64) []byte {
+	flags := uint32(frameCRC | frameTime)
+	if deadline != 0 {
+		flags |= frameTTL
+	}
+
+	start := len(dst)
+	hdr := make([]byte, frameSize(flags, 0))
+	binary.LittleEndian.PutUint32(hdr, flags<<frameLenBits|uint32(len(b))&frameLenMask)
+	binary.LittleEndian.PutUint64(hdr[frameHeaderSize+4:], uint64(time))
+	if deadline != 0 {
+		binary.LittleEndian.PutUint64(hdr[frameHeaderSize+12:], uint64(deadline))
+	}
+	dst = append(dst, hdr...)
+	dst = append(dst, b...)
+
+	raw := dst[start:]
+	crc := crc32.ChecksumIEEE(raw[:frameHeaderSize])
+	crc = crc32.Update(crc, crc32.IEEETable, raw[frameHeaderSize+4:])
+	binary.LittleEndian.PutUint32(raw[frameHeaderSize:], crc)
+	return dst
+}
+
+// readFrameHeader reads the header of a framed message at off, fields are not checked by crc.
+func readFrameHeader(r io.ReaderAt, off int64, legacy bool) (fr *frame, err error) {
+	if legacy {
+		raw := make([]byte, legacyHeaderSize)
+		_, err = r.ReadAt(raw, off)
+		if err != nil {
+			return
+		}
+		fr = &frame{len: int(binary.LittleEndian.Uint16(raw))}
+		fr.n = legacyHeaderSize + int64(fr.len)
+		return
+	}
+
+	raw := make([]byte, frameHeaderSize)
+	_, err = r.ReadAt(raw, off)
+	if err != nil {
+		return
+	}
+	hdr := binary.LittleEndian.Uint32(raw)
+	flags := hdr >> frameLenBits
+	if flags&^frameFlags != 0 || flags&frameCRC == 0 { // all v1 frames are written with crc, zeros are not
+		err = ErrBrokenMsg
+		return
+	}
+	fr = &frame{flags: flags, len: int(hdr & frameLenMask)}
+	fr.n = frameSize(flags, fr.len)
+
+	if flags&(frameTime|frameTTL) == 0 {
+		return
+	}
+	ext := make([]byte, frameSize(flags, 0)-frameHeaderSize)
+	_, err = r.ReadAt(ext, off+frameHeaderSize)
+	if err != nil {
+		return
+	}
+	if flags&frameCRC != 0 {
+		ext = ext[4:]
+	}
+	if flags&frameTime != 0 {
+		fr.time = int64(binary.LittleEndian.Uint64(ext))
+		ext = ext[8:]
+	}
+	if flags&frameTTL != 0 {
+		fr.deadline = int64(binary.LittleEndian.Uint64(ext))
+	}
+	return
+}
+
+// readFrame reads a framed message at off which should end before end.
+func readFrame(r io.ReaderAt, off, end int64, legacy bool) (fr *frame, err error) {
+	fr, err = readFrameHeader(r, off, legacy)
+	if err != nil {
+		return
+	}
+	if off+fr.n > end {
+		err = ErrBrokenMsg
+		return
+	}
+
+	raw := make([]byte, fr.n)
+	_, err = r.ReadAt(raw, off)
+	if err != nil {
+		return
+	}
+	fr.data = raw[fr.n-int64(fr.len):]
+
+	if fr.flags&frameCRC != 0 {
+		crc := crc32.ChecksumIEEE(raw[:frameHeaderSize])
+		crc = crc32.Update(crc, crc32.IEEETable, raw[frameHeaderSize+4:])
+		if crc != binary.LittleEndian.Uint32(raw[frameHeaderSize:]) {
+			err = ErrBrokenMsg
+			return
+		}
+	}
+	return
+}
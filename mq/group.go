@@ -0,0 +1,313 @@
+package mq
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/justmao945/tama/mfs"
+)
+
+var (
+	// ErrInvalidGroup indicates the group name is empty or too long.
+	ErrInvalidGroup = errors.New("invalid group name")
+
+	// ErrInvalidMax indicates max of GetBatch is not positive.
+	ErrInvalidMax = errors.New("invalid max")
+)
+
+// Group is a consumer group of a topic. Groups get the same messages of a topic independently,
+// and each one has its own offset persisted. Topic itself is the default group.
+type Group struct {
+	t      *Topic
+	name   string
+	i      int64       // entry in group region, -1 for the default group
+	gi     *groupIndex // nil for the default group, which is saved in topic index
+	leases map[int64]*lease
+	recv   int64  // off of the next message never received
+	token  uint64 // last issued lease token
+}
+
+// Name returns the group name, empty for the default group.
+func (g *Group) Name() string {
+	return g.name
+}
+
+// Topic returns the topic this group belongs to.
+func (g *Group) Topic() *Topic {
+	return g.t
+}
+
+func (g *Group) off() int64 {
+	if g.gi == nil {
+		if s := g.t.follows(); s != nil {
+			return s.gi.GetOff
+		}
+		return g.t.idx.GetOff
+	}
+	return g.gi.GetOff
+}
+
+func (g *Group) next() int64 {
+	if g.gi == nil {
+		if s := g.t.follows(); s != nil {
+			return s.gi.Next
+		}
+		return g.t.idx.Count - g.t.idx.Pending
+	}
+	return g.gi.Next
+}
+
+// attempts returns deliveries of the message at off by Receive.
+func (g *Group) attempts() int64 {
+	if g.gi == nil {
+		return g.t.idx.Attempts
+	}
+	return g.gi.Attempts
+}
+
+// commit moves this group to off, next is the sequence of message at off.
+// Attempts are kept if off is not changed.
+func (g *Group) commit(f *mfs.File, off, next int64) (err error) {
+	var attempts int64
+	if off == g.off() {
+		attempts = g.attempts()
+	}
+	return g.save(f, off, next, attempts)
+}
+
+// save commits off, next and attempts of the message at off.
+func (g *Group) save(f *mfs.File, off, next, attempts int64) (err error) {
+	if g.gi == nil {
+		newIdx := *g.t.idx
+		newIdx.Flag |= flagDefault
+		newIdx.GetOff = off
+		newIdx.Pending = newIdx.Count - next
+		newIdx.Attempts = attempts
+		return g.t.commit(f, &newIdx)
+	}
+
+	gi := *g.gi
+	gi.GetOff = off
+	gi.Next = next
+	gi.Attempts = attempts
+	gi.Seq++
+	_, err = f.WriteAt(gi.Bytes(), groupOff+g.i*2*slotSize+gi.Seq%2*slotSize)
+	if err != nil {
+		return
+	}
+	g.gi = &gi
+	return
+}
+
+// Pending returns messages can be get by this group.
+func (g *Group) Pending() int64 {
+	g.t.l.RLock()
+	defer g.t.l.RUnlock()
+
+	return g.t.idx.Count - g.next()
+}
+
+// head skips expired messages from off, returns the first live one and the number of skipped ones.
+func (g *Group) head(f *mfs.File, off, now int64) (fr *frame, hoff, skipped int64, err error) {
+	t := g.t
+	for hoff = off; hoff < t.idx.PutOff; hoff += fr.n {
+		fr, err = readFrame(f, hoff, t.idx.PutOff, hoff < t.idx.LegacyEnd)
+		if err != nil || !t.expired(fr, now) {
+			return
+		}
+		skipped++
+	}
+	fr, err = nil, t.eof()
+	return
+}
+
+func (g *Group) peek() (b []byte, err error) {
+	f, err := g.t.file()
+	if err != nil {
+		return
+	}
+
+	fr, _, _, err := g.head(f, g.off(), time.Now().UnixNano())
+	if err != nil {
+		return
+	}
+	b = fr.data
+	return
+}
+
+// Peek only returns the message, won't drop it. Expired messages are skipped.
+func (g *Group) Peek() (b []byte, err error) {
+	g.t.l.RLock()
+	defer g.t.l.RUnlock()
+
+	return g.peek()
+}
+
+// drop drops the head message if it equals b, expired messages before it are dropped too.
+func (g *Group) drop(b []byte) (err error) {
+	f, err := g.t.file()
+	if err != nil {
+		return
+	}
+
+	fr, hoff, skipped, err := g.head(f, g.off(), time.Now().UnixNano())
+	if err != nil {
+		return
+	}
+	if !bytes.Equal(fr.data, b) {
+		err = ErrInvalidMsg
+		return
+	}
+	return g.dropTo(f, hoff+fr.n, g.next()+skipped+1)
+}
+
+// dropTo moves this group to off and releases blocks not used anymore.
+func (g *Group) dropTo(f *mfs.File, off, next int64) (err error) {
+	err = g.commit(f, off, next)
+	if err != nil {
+		return
+	}
+
+	g.t.reclaim(f)
+	return
+}
+
+// Drop should only be called after Peek and with the right message,
+// use Receive and Ack if there are many consumers in this group.
+func (g *Group) Drop(b []byte) error {
+	g.t.l.Lock()
+	defer g.t.l.Unlock()
+
+	return g.drop(b)
+}
+
+func (g *Group) get() (b []byte, err error) {
+	f, err := g.t.file()
+	if err != nil {
+		return
+	}
+
+	fr, hoff, skipped, err := g.head(f, g.off(), time.Now().UnixNano())
+	if err != nil {
+		return
+	}
+
+	err = g.dropTo(f, hoff+fr.n, g.next()+skipped+1)
+	if err != nil {
+		return
+	}
+	b = fr.data
+	return
+}
+
+// Get returns a message in topic and drop it from this group.
+func (g *Group) Get() (b []byte, err error) {
+	g.t.l.Lock()
+	defer g.t.l.Unlock()
+
+	return g.get()
+}
+
+// PeekContext returns the message like Peek, but waits until a message is put, the topic is closed
+// or ctx is done.
+func (g *Group) PeekContext(ctx context.Context) (b []byte, err error) {
+	for {
+		g.t.l.RLock()
+		b, err = g.peek()
+		ready := g.t.ready
+		g.t.l.RUnlock()
+
+		err = g.wait(ctx, ready, err)
+		if err != io.EOF {
+			return
+		}
+	}
+}
+
+// GetContext returns a message and drop it like Get, but waits until a message is put, the topic
+// is closed or ctx is done.
+func (g *Group) GetContext(ctx context.Context) (b []byte, err error) {
+	for {
+		g.t.l.Lock()
+		b, err = g.get()
+		ready := g.t.ready
+		g.t.l.Unlock()
+
+		err = g.wait(ctx, ready, err)
+		if err != io.EOF {
+			return
+		}
+	}
+}
+
+// wait waits for ready if err is io.EOF, returns io.EOF to try again.
+func (g *Group) wait(ctx context.Context, ready <-chan struct{}, err error) error {
+	if err != io.EOF {
+		return err
+	}
+	select {
+	case <-ready:
+		return io.EOF
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// GetBatch returns at most max messages in topic and drop them from this group with one index commit.
+// Messages before a broken one are returned, the broken one is reported by the next call.
+// ErrInvalidMax is returned if max is not positive.
+func (g *Group) GetBatch(max int) (bs [][]byte, err error) {
+	if max <= 0 {
+		err = ErrInvalidMax
+		return
+	}
+
+	g.t.l.Lock()
+	defer g.t.l.Unlock()
+
+	t := g.t
+	off, next := g.off(), g.next()
+	if off >= t.idx.PutOff {
+		err = t.eof()
+		return
+	}
+
+	f, err := t.file()
+	if err != nil {
+		return
+	}
+
+	now := time.Now().UnixNano()
+	for len(bs) < max && off < t.idx.PutOff {
+		var fr *frame
+		fr, err = readFrame(f, off, t.idx.PutOff, off < t.idx.LegacyEnd)
+		if err != nil {
+			break
+		}
+		off += fr.n
+		next++
+		if !t.expired(fr, now) {
+			bs = append(bs, fr.data)
+		}
+	}
+	if len(bs) > 0 {
+		err = nil
+	} else if err == nil { // all expired
+		err = t.eof()
+	}
+	if off == g.off() {
+		return
+	}
+
+	err1 := g.commit(f, off, next)
+	if err1 != nil {
+		bs, err = nil, err1
+		return
+	}
+
+	t.reclaim(f)
+	return
+}
@@ -0,0 +1,221 @@
+package mq
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fhck-mq")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mq, err := NewQueue(dir, nil)
+	require.NoError(t, err)
+
+	topic, err := mq.Get(0)
+	require.NoError(t, err)
+
+	_, err = topic.Group("")
+	require.Equal(t, ErrInvalidGroup, err)
+
+	for i := 0; i < 3; i++ {
+		err = topic.Put([]byte(fmt.Sprint(i)))
+		require.NoError(t, err)
+	}
+
+	g1, err := topic.Group("g1")
+	require.NoError(t, err)
+	require.Equal(t, "g1", g1.Name())
+	require.Equal(t, int64(3), g1.Pending())
+
+	b, err := topic.Get()
+	require.NoError(t, err)
+	require.Equal(t, []byte("0"), b)
+
+	// starts from the slowest group
+	g2, err := topic.Group("g2")
+	require.NoError(t, err)
+	require.Equal(t, int64(3), g2.Pending())
+
+	b, err = g2.Get()
+	require.NoError(t, err)
+	require.Equal(t, []byte("0"), b)
+	b, err = g2.Get()
+	require.NoError(t, err)
+	require.Equal(t, []byte("1"), b)
+
+	err = topic.Put([]byte("3"))
+	require.NoError(t, err)
+	require.Equal(t, int64(3), topic.Pending())
+	require.Equal(t, int64(4), g1.Pending())
+	require.Equal(t, int64(2), g2.Pending())
+
+	b, err = g1.Peek()
+	require.NoError(t, err)
+	require.Equal(t, []byte("0"), b)
+	err = g1.Drop(b)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), g1.Pending())
+
+	require.Equal(t, []*Group{g1, g2}, topic.Groups())
+	mq.Close()
+
+	// offsets are persisted
+	mq, err = NewQueue(dir, nil)
+	require.NoError(t, err)
+	defer mq.Close()
+
+	topic, err = mq.Get(0)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(topic.Groups()))
+	require.Equal(t, int64(3), topic.Pending())
+
+	g1, err = topic.Group("g1")
+	require.NoError(t, err)
+	require.Equal(t, int64(3), g1.Pending())
+	g2, err = topic.Group("g2")
+	require.NoError(t, err)
+	require.Equal(t, int64(2), g2.Pending())
+
+	for _, m := range []string{"2", "3"} {
+		b, err = g2.Get()
+		require.NoError(t, err)
+		require.Equal(t, []byte(m), b)
+	}
+	_, err = g2.Get()
+	require.Equal(t, io.EOF, err)
+
+	err = topic.DeleteGroup("g2")
+	require.NoError(t, err)
+	err = topic.DeleteGroup("g2")
+	require.Equal(t, ErrInvalidGroup, err)
+	require.Equal(t, []*Group{g1}, topic.Groups())
+
+	// deleted entry is not reused
+	g3, err := topic.Group("g3")
+	require.NoError(t, err)
+	require.Equal(t, int64(2), g3.i)
+	require.Equal(t, int64(3), g3.Pending())
+}
+
+func TestGroupReclaim(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fhck-mq")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mq, err := NewQueue(dir, nil)
+	require.NoError(t, err)
+	defer mq.Close()
+
+	topic, err := mq.Get(0)
+	require.NoError(t, err)
+
+	g, err := topic.Group("slow")
+	require.NoError(t, err)
+
+	msg := make([]byte, 60<<10)
+	for i := 0; i < 40; i++ {
+		err = topic.Put(msg)
+		require.NoError(t, err)
+	}
+	for i := 0; i < 30; i++ {
+		_, err = topic.Get()
+		require.NoError(t, err)
+	}
+
+	// the slow group holds the storage
+	require.Equal(t, int64(0), topic.rec)
+
+	for i := 0; i < 30; i++ {
+		_, err = g.Get()
+		require.NoError(t, err)
+	}
+
+	blkSize := int64(mq.vol.BlockSize)
+	require.Equal(t, 3*blkSize, topic.rec)
+}
+
+func TestGroupReclaimUnusedDefault(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fhck-mq")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	put := func(topic *Topic, g *Group) {
+		msg := make([]byte, 60<<10)
+		for i := 0; i < 40; i++ {
+			err := topic.Put(append(msg, byte(i)))
+			require.NoError(t, err)
+		}
+		for i := 0; i < 30; i++ {
+			_, err := g.Get()
+			require.NoError(t, err)
+		}
+	}
+
+	mq, err := NewQueue(dir, nil)
+	require.NoError(t, err)
+
+	// the default group is independent by default
+	topic, err := mq.Get(1)
+	require.NoError(t, err)
+	g, err := topic.Group("g")
+	require.NoError(t, err)
+	put(topic, g)
+	require.Equal(t, int64(0), topic.rec)
+	require.Equal(t, int64(40), topic.Pending())
+	b, err := topic.Get()
+	require.NoError(t, err)
+	require.Equal(t, byte(0), b[len(b)-1])
+	mq.Close()
+
+	cfg := *DefaultConfig
+	cfg.FollowGroups = true
+	mq, err = NewQueue(dir, &cfg)
+	require.NoError(t, err)
+
+	topic, err = mq.Get(0)
+	require.NoError(t, err)
+	g, err = topic.Group("g")
+	require.NoError(t, err)
+	put(topic, g)
+
+	// the default group is never used, it does not hold the storage
+	blkSize := int64(mq.vol.BlockSize)
+	require.Equal(t, 3*blkSize, topic.rec)
+	require.Equal(t, int64(10), topic.Pending())
+
+	// used before
+	t1, err := mq.Get(1)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), t1.rec)
+	require.Equal(t, int64(39), t1.Pending())
+	mq.Close()
+
+	mq, err = NewQueue(dir, &cfg)
+	require.NoError(t, err)
+	defer mq.Close()
+
+	topic, err = mq.Get(0)
+	require.NoError(t, err)
+	require.Equal(t, 3*blkSize, topic.rec)
+
+	// starts from the slowest group once used, and holds the storage since then
+	b, err = topic.Get()
+	require.NoError(t, err)
+	require.Equal(t, byte(30), b[len(b)-1])
+
+	g, err = topic.Group("g")
+	require.NoError(t, err)
+	for i := 0; i < 9; i++ {
+		_, err = g.Get()
+		require.NoError(t, err)
+	}
+	require.Equal(t, int64(9), topic.Pending())
+	require.Equal(t, 3*blkSize, topic.rec)
+}
@@ -0,0 +1,224 @@
+package mq
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+
+	"github.com/justmao945/tama/mfs"
+	"github.com/qiniu/bytes"
+)
+
+// Topic file layout, offsets are stable and never moved:
+//
+//	| legacy index | data ... | meta: index slots | retention slots | dead letter slots | ... | group 0 slots | ...
+//	| seq entry 0 | seq entry 1 | ... | dedup key 0 | dedup key 1 | ...
+//
+// Index, retention and groups are committed to their two slots alternately, so a torn write can only
+// break one of them. The valid slot with the larger Seq wins on open.
+const (
+	headerSize   = 48                   // legacy index at 0: 4 + 4 + 5 * 8, data is put after it
+	metaOff      = 1 << 49              // start of meta region, data is put before it
+	retentionOff = metaOff + 2*slotSize // start of retention slots
+	deadOff      = metaOff + 4*slotSize // start of dead letter slots
+	groupOff     = metaOff + 4<<10      // start of group slots
+	seqOff       = metaOff + 1<<45      // start of sparse seq index, entry k is the off of message k * seqInterval
+	dedupOff     = metaOff + 1<<46      // start of dedup key log
+	slotSize     = 128                  // crc 4B + index 4 + 8 * 8, and room for new fields
+)
+
+const (
+	maxGroupName = 32
+)
+
+type index struct {
+	Flag      int32 // index flag
+	PutOff    int64
+	GetOff    int64
+	Count     int64 // all messages put to this Topic
+	Pending   int64 // pending messages can be get
+	LegacyEnd int64 // messages before this off are written with legacy framing
+	Seq       int64 // commit sequence, written to slot Seq % 2
+	DedupOff  int64 // start of dedup keys not expired, 0 if never put with key
+	DedupEnd  int64 // end of dedup keys committed with messages
+	Attempts  int64 // deliveries of the message at GetOff by the default group
+}
+
+func (i *index) Bytes() []byte {
+	return encodeSlot(i)
+}
+
+// parseIndex parses a slot or a legacy index.
+func parseIndex(b []byte) (idx *index, err error) {
+	idx = &index{}
+	err = decodeSlot(b, idx)
+	return
+}
+
+// group index saved in group slots
+type groupIndex struct {
+	Flag     int32
+	GetOff   int64
+	Next     int64 // sequence of the next message to get
+	Seq      int64 // commit sequence, written to slot Seq % 2
+	Name     [maxGroupName]byte
+	Attempts int64 // deliveries of the message at GetOff
+}
+
+const (
+	groupDeleted = 1 << iota
+)
+
+// retention limits saved in retention slots
+type retentionIndex struct {
+	MaxBytes int64
+	MaxAge   int64 // in nanoseconds
+	Seq      int64 // commit sequence, written to slot Seq % 2
+}
+
+// dead letter config saved in dead letter slots
+type deadIndex struct {
+	Topic       uint32
+	MaxAttempts int64
+	Seq         int64 // commit sequence, written to slot Seq % 2
+}
+
+// slot is an entry committed to two slots alternately.
+type slot interface {
+	seq() int64
+}
+
+func (i *index) seq() int64          { return i.Seq }
+func (g *groupIndex) seq() int64     { return g.Seq }
+func (r *retentionIndex) seq() int64 { return r.Seq }
+func (d *deadIndex) seq() int64      { return d.Seq }
+
+func (g *groupIndex) Bytes() []byte {
+	return encodeSlot(g)
+}
+
+func parseGroupIndex(b []byte) (gi *groupIndex, err error) {
+	gi = &groupIndex{}
+	err = decodeSlot(b, gi)
+	return
+}
+
+// encodeSlot returns | crc32 4B | v |, padding to slotSize.
+func encodeSlot(v interface{}) []byte {
+	b := make([]byte, slotSize)
+	w := bytes.NewWriter(b[4:])
+	binary.Write(w, binary.LittleEndian, v)
+	binary.LittleEndian.PutUint32(b, crc32.ChecksumIEEE(b[4:]))
+	return b
+}
+
+func decodeSlot(b []byte, v interface{}) (err error) {
+	if binary.LittleEndian.Uint32(b) != crc32.ChecksumIEEE(b[4:]) {
+		err = ErrBrokenIndex
+		return
+	}
+	raw := make([]byte, slotSize) // legacy index has no trailing fields
+	copy(raw, b)
+
+	r := bytes.NewReader(raw[4:])
+	binary.Read(r, binary.LittleEndian, v)
+	return
+}
+
+// loadSlot returns the newest valid one of the two slots at off, nil if there's no valid slot.
+func loadSlot(f *mfs.File, off int64, v func() slot) (s slot, err error) {
+	for i := int64(0); i < 2; i++ {
+		raw := make([]byte, slotSize)
+		_, err = f.ReadAt(raw, off+i*slotSize)
+		if err == io.EOF { // not written yet
+			err = nil
+			return
+		}
+		if err != nil {
+			return
+		}
+		s0 := v()
+		if decodeSlot(raw, s0) != nil { // torn or never written
+			continue
+		}
+		if s == nil || s0.seq() > s.seq() {
+			s = s0
+		}
+	}
+	return
+}
+
+// loadIndex returns the newest valid slot, or the legacy index if there's no slot.
+// Returns nil index if this is a new file.
+func loadIndex(f *mfs.File) (idx *index, err error) {
+	s, err := loadSlot(f, metaOff, func() slot { return &index{} })
+	if err != nil {
+		return
+	}
+	if s != nil {
+		idx = s.(*index)
+		return
+	}
+
+	raw := make([]byte, headerSize)
+	_, err = f.ReadAt(raw, 0)
+	if err == io.EOF { // new index
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	return parseIndex(raw)
+}
+
+// commit writes idx to the next slot and makes it the current index.
+func (t *Topic) commit(f *mfs.File, idx *index) (err error) {
+	idx.Seq = t.idx.Seq + 1
+	_, err = f.WriteAt(idx.Bytes(), metaOff+idx.Seq%2*slotSize)
+	if err != nil {
+		return
+	}
+	t.idx = idx
+	return
+}
+
+// loadGroups returns all groups saved in group region, including deleted ones.
+func loadGroups(f *mfs.File) (gis []*groupIndex, err error) {
+	for off := int64(groupOff); ; off += 2 * slotSize {
+		var s slot
+		s, err = loadSlot(f, off, func() slot { return &groupIndex{} })
+		if err != nil || s == nil { // end of groups
+			return
+		}
+		gis = append(gis, s.(*groupIndex))
+	}
+}
+
+// loadRetention returns the retention limits, zero limits if never set.
+func loadRetention(f *mfs.File) (ri *retentionIndex, err error) {
+	s, err := loadSlot(f, retentionOff, func() slot { return &retentionIndex{} })
+	if err != nil {
+		return
+	}
+	if s == nil {
+		ri = &retentionIndex{}
+		return
+	}
+	ri = s.(*retentionIndex)
+	return
+}
+
+// loadDead returns the dead letter config, disabled if never set.
+func loadDead(f *mfs.File) (di *deadIndex, err error) {
+	s, err := loadSlot(f, deadOff, func() slot { return &deadIndex{} })
+	if err != nil {
+		return
+	}
+	if s == nil {
+		di = &deadIndex{}
+		return
+	}
+	di = s.(*deadIndex)
+	return
+}
@@ -0,0 +1,273 @@
+package mq
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/justmao945/tama/mfs"
+)
+
+var (
+	// ErrInvalidReceipt indicates the receipt is expired, already acked or not issued by this group.
+	ErrInvalidReceipt = errors.New("invalid receipt")
+)
+
+// Receipt identifies exactly one delivery of a message.
+type Receipt struct {
+	off   int64
+	token uint64
+}
+
+func (r Receipt) String() string {
+	return fmt.Sprintf("%x.%x", r.off, r.token)
+}
+
+// ParseReceipt parses a receipt from the result of Receipt.String.
+func ParseReceipt(s string) (r Receipt, err error) {
+	_, err = fmt.Sscanf(s, "%x.%x", &r.off, &r.token)
+	if err != nil {
+		err = ErrInvalidReceipt
+	}
+	return
+}
+
+// Message is a message received from a group.
+type Message struct {
+	Data     []byte
+	Receipt  Receipt
+	Attempts int // deliveries of this message including this one
+}
+
+// lease of an in-flight message, it's invisible to other receivers before deadline.
+type lease struct {
+	off      int64 // frame off
+	n        int64 // frame size
+	token    uint64
+	deadline time.Time
+	attempts int // deliveries of this message
+	acked    bool
+	dead     bool // waiting to be moved to the dead letter topic at head
+}
+
+// Receive returns a message and hides it from other receivers for timeout.
+// The message must be acked before timeout, otherwise it will be delivered again.
+// Leases are not persisted, all messages not acked are delivered again after restart,
+// only attempts of the message at head are kept. Expired messages are acked without delivery,
+// and messages delivered for max attempts are moved to the dead letter topic if configured.
+// The move happens once the message is at head, so it's atomic with the drop from this group.
+func (g *Group) Receive(timeout time.Duration) (m *Message, err error) {
+	for {
+		var dead *Message
+		m, dead, err = g.receive(timeout)
+		if err != nil || dead == nil {
+			return
+		}
+		err = g.deadLetter(dead)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// receive returns a message to deliver, or a dead one leased for moving to the dead letter topic.
+func (g *Group) receive(timeout time.Duration) (m, dead *Message, err error) {
+	g.t.l.Lock()
+	defer g.t.l.Unlock()
+
+	t := g.t
+	f, err := t.file()
+	if err != nil {
+		return
+	}
+
+	if g.leases == nil {
+		g.leases = make(map[int64]*lease)
+	}
+
+	now := time.Now()
+	for {
+		var l *lease
+		var fr *frame
+		l, fr, err = g.pick(f, now)
+		if err != nil {
+			break
+		}
+		if t.expired(fr, now.UnixNano()) {
+			l.acked = true
+			continue
+		}
+
+		g.token++
+		l.token = g.token
+		l.deadline = now.Add(timeout)
+		m = &Message{Data: fr.data, Receipt: Receipt{off: l.off, token: l.token}, Attempts: l.attempts}
+		if t.dead.MaxAttempts > 0 && int64(l.attempts) >= t.dead.MaxAttempts {
+			if l.off != g.off() {
+				l.dead = true
+				continue
+			}
+			m, dead = nil, m
+			return
+		}
+		if l.off == g.off() {
+			err = g.save(f, l.off, g.next(), int64(l.attempts+1))
+			if err != nil {
+				m = nil
+				return
+			}
+		}
+		l.attempts++
+		m.Attempts++
+		return
+	}
+
+	err1 := g.advance(f) // over expired ones
+	if err1 != nil {
+		err = err1
+	}
+	return
+}
+
+// pick reads the first expired or nacked message, or the next message never received.
+// Dead messages are picked only at head.
+func (g *Group) pick(f *mfs.File, now time.Time) (l *lease, fr *frame, err error) {
+	t := g.t
+	for off, l0 := range g.leases {
+		if off < g.off() { // dropped by others
+			delete(g.leases, off)
+			continue
+		}
+		if l0.acked || l0.dead && l0.off != g.off() || !l0.dead && now.Before(l0.deadline) {
+			continue
+		}
+		if l == nil || l0.off < l.off {
+			l = l0
+		}
+	}
+
+	if l == nil {
+		if g.recv < g.off() {
+			g.recv = g.off()
+		}
+		if g.recv >= t.idx.PutOff {
+			if t.idx.Flag&flagClosed != 0 && len(g.leases) == 0 {
+				err = ErrClosedTopic
+			} else {
+				err = io.EOF
+			}
+			return
+		}
+		l = &lease{off: g.recv}
+		if l.off == g.off() {
+			l.attempts = int(g.attempts())
+		}
+	}
+
+	fr, err = readFrame(f, l.off, t.idx.PutOff, l.off < t.idx.LegacyEnd)
+	if err != nil {
+		return
+	}
+
+	l.n = fr.n
+	if l.off == g.recv {
+		g.leases[l.off] = l
+		g.recv += fr.n
+	}
+	return
+}
+
+// lease returns the lease of a receipt if it's not acked.
+func (g *Group) lease(r Receipt) (l *lease, err error) {
+	l, ok := g.leases[r.off]
+	if ok && r.off < g.off() { // dropped by others
+		delete(g.leases, r.off)
+		ok = false
+	}
+	if !ok || l.token != r.token || l.acked {
+		err = ErrInvalidReceipt
+	}
+	return
+}
+
+// Ack removes a received message from this group.
+func (g *Group) Ack(r Receipt) (err error) {
+	g.t.l.Lock()
+	defer g.t.l.Unlock()
+
+	l, err := g.lease(r)
+	if err != nil {
+		return
+	}
+	l.acked = true
+
+	f, err := g.t.file()
+	if err != nil {
+		return
+	}
+	return g.advance(f)
+}
+
+// advance moves this group forward over all acked messages at head.
+func (g *Group) advance(f *mfs.File) (err error) {
+	off, next := g.off(), g.next()
+	for {
+		l, ok := g.leases[off]
+		if !ok || !l.acked {
+			break
+		}
+		delete(g.leases, off)
+		off += l.n
+		next++
+	}
+	if off == g.off() {
+		return
+	}
+
+	err = g.commit(f, off, next)
+	if err != nil {
+		return
+	}
+
+	g.t.reclaim(f)
+	return
+}
+
+// leased reports whether messages in [off, end) have leases not acked, other than except.
+func (g *Group) leased(off, end int64, except *lease) bool {
+	for o, l := range g.leases {
+		if o >= off && o < end && !l.acked && l != except {
+			return true
+		}
+	}
+	return false
+}
+
+// Nack makes a received message visible to receivers again immediately.
+func (g *Group) Nack(r Receipt) (err error) {
+	g.t.l.Lock()
+	defer g.t.l.Unlock()
+
+	l, err := g.lease(r)
+	if err != nil {
+		return
+	}
+	l.deadline = time.Time{}
+	return
+}
+
+// Receive returns a message of the default group, see Group.Receive.
+func (t *Topic) Receive(timeout time.Duration) (m *Message, err error) {
+	return t.def.Receive(timeout)
+}
+
+// Ack removes a received message from the default group.
+func (t *Topic) Ack(r Receipt) error {
+	return t.def.Ack(r)
+}
+
+// Nack makes a received message visible to receivers of the default group again.
+func (t *Topic) Nack(r Receipt) error {
+	return t.def.Nack(r)
+}
@@ -0,0 +1,148 @@
+package mq
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLease(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fhck-mq")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mq, err := NewQueue(dir, nil)
+	require.NoError(t, err)
+
+	topic, err := mq.Get(0)
+	require.NoError(t, err)
+
+	_, err = topic.Receive(time.Minute)
+	require.Equal(t, io.EOF, err)
+
+	for i := 0; i < 3; i++ {
+		err = topic.Put([]byte(fmt.Sprint(i)))
+		require.NoError(t, err)
+	}
+
+	m0, err := topic.Receive(time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, []byte("0"), m0.Data)
+
+	m1, err := topic.Receive(time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, []byte("1"), m1.Data)
+
+	r, err := ParseReceipt(m1.Receipt.String())
+	require.NoError(t, err)
+	require.Equal(t, m1.Receipt, r)
+
+	// ack out of order, head is not moved
+	err = topic.Ack(m1.Receipt)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), topic.Pending())
+	err = topic.Ack(m1.Receipt)
+	require.Equal(t, ErrInvalidReceipt, err)
+
+	// nack makes it visible again with a new receipt
+	err = topic.Nack(m0.Receipt)
+	require.NoError(t, err)
+	m, err := topic.Receive(time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, []byte("0"), m.Data)
+	err = topic.Ack(m0.Receipt)
+	require.Equal(t, ErrInvalidReceipt, err)
+
+	err = topic.Ack(m.Receipt)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), topic.Pending())
+
+	// expired lease
+	m2, err := topic.Receive(time.Millisecond)
+	require.NoError(t, err)
+	require.Equal(t, []byte("2"), m2.Data)
+	_, err = topic.Receive(time.Minute)
+	require.Equal(t, io.EOF, err)
+
+	time.Sleep(10 * time.Millisecond)
+	m, err = topic.Receive(time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, []byte("2"), m.Data)
+	err = topic.Ack(m2.Receipt)
+	require.Equal(t, ErrInvalidReceipt, err)
+
+	// not acked messages are delivered again after restart
+	mq.Close()
+	mq, err = NewQueue(dir, nil)
+	require.NoError(t, err)
+	defer mq.Close()
+
+	topic, err = mq.Get(0)
+	require.NoError(t, err)
+	m, err = topic.Receive(time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, []byte("2"), m.Data)
+
+	err = topic.Close()
+	require.NoError(t, err)
+	_, err = topic.Receive(time.Minute)
+	require.Equal(t, io.EOF, err)
+	err = topic.Ack(m.Receipt)
+	require.NoError(t, err)
+	_, err = topic.Receive(time.Minute)
+	require.Equal(t, ErrClosedTopic, err)
+}
+
+func TestLeaseParallel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fhck-mq")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mq, err := NewQueue(dir, nil)
+	require.NoError(t, err)
+	defer mq.Close()
+
+	topic, err := mq.Get(0)
+	require.NoError(t, err)
+
+	for i := 0; i < 1000; i++ {
+		err = topic.Put([]byte(fmt.Sprint(i)))
+		require.NoError(t, err)
+	}
+
+	var l sync.Mutex
+	seen := make(map[string]bool)
+
+	var wg sync.WaitGroup
+	wg.Add(10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			defer wg.Done()
+			for {
+				m, err := topic.Receive(time.Minute)
+				if err == io.EOF {
+					return
+				}
+				require.NoError(t, err)
+
+				l.Lock()
+				require.False(t, seen[string(m.Data)])
+				seen[string(m.Data)] = true
+				l.Unlock()
+
+				err = topic.Ack(m.Receipt)
+				require.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	require.Equal(t, 1000, len(seen))
+	require.Equal(t, int64(0), topic.Pending())
+}
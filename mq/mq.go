@@ -1,50 +1,200 @@
 package mq
 
 import (
+	"math"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/justmao945/tama/mfs"
 )
 
+// Config the message queue.
+//
+// Messages are written to memory mapped files, and flushed to disk by the OS at any time.
+// SyncPuts and SyncInterval bound the messages may be lost if the machine crashes,
+// both 0 means never sync explicitly.
+type Config struct {
+	Recover      bool          // truncate a topic to the last good message if broken messages are found on open
+	SyncPuts     int           // sync a topic after every N puts, 1 to sync every put, 0 to disable
+	SyncInterval time.Duration // sync the queue every interval, 0 to disable
+	DedupWindow  time.Duration // keys of PutWithKey are rejected within the window, 0 to keep them forever
+
+	// FollowGroups makes the default group of a topic follow the slowest named group until it gets
+	// messages, so storage is reclaimed if only named groups consume. Messages consumed by all named
+	// groups before that are skipped by the default group.
+	FollowGroups bool
+}
+
+// DefaultConfig recovers broken topics automatically, leaves sync to the OS,
+// and remembers dedup keys for 10 minutes.
+var DefaultConfig = &Config{
+	Recover:     true,
+	DedupWindow: 10 * time.Minute,
+}
+
 // Queue can have many topics.
 type Queue struct {
+	*Config
 	vol    *mfs.Volume
 	topics map[uint32]*Topic
+	reg    *registry
+	txn    *txnIndex
+	txnL   sync.Mutex     // commits transactions one by one
+	done   chan struct{}  // closed to stop syncing
+	wg     sync.WaitGroup // waits syncLoop
+	once   sync.Once
+	syncs  int64 // syncs done by syncLoop
 	l      sync.RWMutex
 }
 
 // NewQueue create a message queue.
-func NewQueue(path string) (q *Queue, err error) {
+func NewQueue(path string, cfg *Config) (q *Queue, err error) {
+	if cfg == nil {
+		cfg = DefaultConfig
+	}
+
 	// pre-alloc a 256M round file with 512K/Block
 	vol, err := mfs.Open(path, &mfs.Config{RoundSize: 256 << 20, BlockSize: 512 << 10})
 	if err != nil {
 		return
 	}
 
-	q = &Queue{vol: vol, topics: make(map[uint32]*Topic)}
+	defer func() {
+		if err != nil {
+			vol.Close()
+		}
+	}()
+
+	q = &Queue{Config: cfg, vol: vol, topics: make(map[uint32]*Topic), txn: &txnIndex{}, done: make(chan struct{})}
+
+	rf, err := vol.Open(registryFd)
+	if err != nil {
+		return
+	}
+	q.reg, err = loadRegistry(rf)
+	if err != nil {
+		return
+	}
 
+	var tf *mfs.File
 	for _, f := range vol.Files() {
-		_, err = q.Get(f.Fd())
+		if f.Fd() == txnFd {
+			tf = f
+		}
+		if f.Fd() >= reservedFd {
+			continue
+		}
+		var t *Topic
+		t, err = q.Get(f.Fd())
+		if err != nil {
+			return
+		}
+		if t.idx.Flag&flagDeleted != 0 { // crashed while deleting
+			err = q.Delete(t.id)
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	if tf != nil { // finish the last transaction
+		err = q.recoverTxn(tf)
 		if err != nil {
 			return
 		}
 	}
+
+	if cfg.SyncInterval > 0 {
+		q.wg.Add(1)
+		go q.syncLoop(cfg.SyncInterval)
+	}
 	return
 }
 
-// Topics returns all topics in this queue.
+// Topics returns all topics in this queue ordered by id, with names if registered.
 func (q *Queue) Topics() (res []*Topic) {
 	q.l.RLock()
-	q.l.RUnlock()
+	defer q.l.RUnlock()
 
 	for _, t := range q.topics {
 		res = append(res, t)
 	}
+	sort.Sort(byID(res))
+	return
+}
+
+// Lookup returns the topic id of a registered name.
+func (q *Queue) Lookup(name string) (id uint32, ok bool) {
+	q.l.RLock()
+	defer q.l.RUnlock()
+
+	id, ok = q.reg.names[name]
+	return
+}
+
+// GetByName returns a topic by name, will register the name with a new id if is not exist.
+func (q *Queue) GetByName(name string) (t *Topic, err error) {
+	if name == "" || len(name) > MaxTopicName {
+		err = ErrInvalidTopic
+		return
+	}
+
+	id, ok := q.Lookup(name)
+	if !ok {
+		id, err = q.register(name)
+		if err != nil {
+			return
+		}
+	}
+	return q.Get(id)
+}
+
+// register saves name with an unused id.
+func (q *Queue) register(name string) (id uint32, err error) {
+	q.l.Lock()
+	defer q.l.Unlock()
+
+	id, ok := q.reg.names[name]
+	if ok {
+		return
+	}
+
+	// next to the max used id
+	next := int64(0)
+	for id := range q.topics {
+		if int64(id) >= next {
+			next = int64(id) + 1
+		}
+	}
+	for id := range q.reg.ids {
+		if int64(id) >= next {
+			next = int64(id) + 1
+		}
+	}
+	if next >= reservedFd {
+		err = ErrReservedTopic
+		return
+	}
+
+	f, err := q.vol.Open(registryFd)
+	if err != nil {
+		return
+	}
+
+	id = uint32(next)
+	err = q.reg.add(f, id, 0, name)
 	return
 }
 
 // Get returns a topic from queue, will create a new one if is not exist.
 func (q *Queue) Get(id uint32) (t *Topic, err error) {
+	if id >= reservedFd {
+		err = ErrReservedTopic
+		return
+	}
+
 	q.l.RLock()
 	t, ok := q.topics[id]
 	q.l.RUnlock()
@@ -70,7 +220,98 @@ func (q *Queue) Get(id uint32) (t *Topic, err error) {
 	return
 }
 
-// Close release all resources.
+// Find returns an opened topic, ok is false if it's not exist. Unlike Get, it never creates one.
+func (q *Queue) Find(id uint32) (t *Topic, ok bool) {
+	q.l.RLock()
+	defer q.l.RUnlock()
+
+	t, ok = q.topics[id]
+	return
+}
+
+// Delete removes a topic and releases all its storage, the topic can not be used anymore.
+func (q *Queue) Delete(id uint32) (err error) {
+	q.l.Lock()
+	defer q.l.Unlock()
+
+	t, ok := q.topics[id]
+	if !ok {
+		return
+	}
+
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	// mark as deleted first, finish deleting on open if crashed
+	if t.idx.Flag&flagDeleted == 0 {
+		var f *mfs.File
+		f, err = t.file()
+		if err != nil {
+			return
+		}
+		newIdx := *t.idx
+		newIdx.Flag |= flagDeleted
+		err = t.commit(f, &newIdx)
+		if err != nil {
+			return
+		}
+	}
+
+	if name, ok := q.reg.ids[id]; ok {
+		var rf *mfs.File
+		rf, err = q.vol.Open(registryFd)
+		if err != nil {
+			return
+		}
+		err = q.reg.add(rf, id, recordDeleted, name)
+		if err != nil {
+			return
+		}
+	}
+
+	// release the block of index slots last, the topic is still marked as deleted if crashed
+	// while releasing, seq index and dedup keys are above it
+	f, err := q.vol.Open(id)
+	if err != nil {
+		return
+	}
+	blk := int64(q.vol.BlockSize)
+	f.Discard(0, metaOff)
+	f.Discard(metaOff+blk, math.MaxInt64-metaOff-blk)
+	q.vol.Remove(id)
+	delete(q.topics, id)
+	t.wake()
+	return
+}
+
+// Sync flushes all topics to disk.
+func (q *Queue) Sync() error {
+	return q.vol.Sync()
+}
+
+// syncLoop syncs the queue every interval until closed.
+func (q *Queue) syncLoop(interval time.Duration) {
+	defer q.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			q.Sync()
+			atomic.AddInt64(&q.syncs, 1)
+		case <-q.done:
+			return
+		}
+	}
+}
+
+// Close release all resources, closing again does nothing.
 func (q *Queue) Close() {
-	q.vol.Close()
+	q.once.Do(func() {
+		close(q.done)
+		q.wg.Wait()
+		q.vol.Close()
+	})
 }
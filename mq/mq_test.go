@@ -1,21 +1,39 @@
 package mq
 
 import (
+	"context"
+	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
 
 func TestIndex(t *testing.T) {
-	idx := &index{PutOff: 1, GetOff: 2, Flag: 1, Count: 100, Pending: 20}
+	idx := &index{PutOff: 1, GetOff: 2, Flag: 1, Count: 100, Pending: 20, LegacyEnd: 3, Seq: 4, DedupOff: dedupOff, DedupEnd: dedupOff + 5}
 	idx2, err := parseIndex(idx.Bytes())
 	require.NoError(t, err)
 	require.Equal(t, idx, idx2)
+
+	idx.LegacyEnd, idx.Seq, idx.DedupOff, idx.DedupEnd = 0, 0, 0, 0
+	idx2, err = parseIndex(legacyIndex(idx))
+	require.NoError(t, err)
+	require.Equal(t, idx, idx2)
+}
+
+// legacyIndex returns the index written by the old version at 0.
+func legacyIndex(idx *index) []byte {
+	b := idx.Bytes()[:headerSize]
+	binary.LittleEndian.PutUint32(b, crc32.ChecksumIEEE(b[4:]))
+	return b
 }
 
 func TestMQ(t *testing.T) {
@@ -25,7 +43,7 @@ func TestMQ(t *testing.T) {
 
 	t.Log(dir)
 
-	mq, err := NewQueue(dir)
+	mq, err := NewQueue(dir, nil)
 	require.NoError(t, err)
 	defer mq.Close()
 
@@ -88,7 +106,7 @@ func TestMQParallel(t *testing.T) {
 
 	t.Log(dir)
 
-	mq, err := NewQueue(dir)
+	mq, err := NewQueue(dir, nil)
 	require.NoError(t, err)
 
 	var wg sync.WaitGroup
@@ -123,3 +141,510 @@ func TestMQParallel(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestMQReclaim(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fhck-mq")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	t.Log(dir)
+
+	mq, err := NewQueue(dir, nil)
+	require.NoError(t, err)
+
+	topic, err := mq.Get(1)
+	require.NoError(t, err)
+
+	msg := make([]byte, 60<<10)
+	for i := range msg {
+		msg[i] = 'x'
+	}
+
+	// write and consume about 4 blocks
+	for i := 0; i < 40; i++ {
+		err = topic.Put(msg)
+		require.NoError(t, err)
+	}
+	for i := 0; i < 30; i++ {
+		_, err = topic.Get()
+		require.NoError(t, err)
+	}
+
+	f, err := mq.vol.Open(1)
+	require.NoError(t, err)
+
+	blkSize := int64(mq.vol.BlockSize)
+	require.True(t, topic.idx.GetOff > 3*blkSize)
+	require.Equal(t, 3*blkSize, topic.rec)
+
+	// consumed blocks are holes now
+	b := make([]byte, 4)
+	_, err = f.ReadAt(b, blkSize)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0, 0, 0, 0}, b)
+
+	// offsets still work after restart
+	mq.Close()
+	mq, err = NewQueue(dir, nil)
+	require.NoError(t, err)
+	defer mq.Close()
+
+	topic, err = mq.Get(1)
+	require.NoError(t, err)
+	require.Equal(t, int64(10), topic.Pending())
+
+	for i := 0; i < 10; i++ {
+		b, err = topic.Get()
+		require.NoError(t, err)
+		require.Equal(t, msg, b)
+	}
+	_, err = topic.Get()
+	require.Equal(t, io.EOF, err)
+}
+
+func TestMQLargeMsg(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fhck-mq")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mq, err := NewQueue(dir, nil)
+	require.NoError(t, err)
+	defer mq.Close()
+
+	topic, err := mq.Get(0)
+	require.NoError(t, err)
+
+	err = topic.Put(make([]byte, MaxMsgSize+1))
+	require.Equal(t, ErrTooLargeMsg, err)
+
+	msg := make([]byte, 3<<20)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	err = topic.Put(msg)
+	require.NoError(t, err)
+	err = topic.Put([]byte("abcd"))
+	require.NoError(t, err)
+
+	b, err := topic.Get()
+	require.NoError(t, err)
+	require.Equal(t, msg, b)
+
+	b, err = topic.Get()
+	require.NoError(t, err)
+	require.Equal(t, []byte("abcd"), b)
+}
+
+func TestMQLegacy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fhck-mq")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mq, err := NewQueue(dir, nil)
+	require.NoError(t, err)
+
+	// write a topic with legacy framing
+	f, err := mq.vol.Open(3)
+	require.NoError(t, err)
+
+	idx := &index{PutOff: headerSize, GetOff: headerSize}
+	for _, m := range []string{"abc", "defg"} {
+		raw := make([]byte, 2+len(m))
+		binary.LittleEndian.PutUint16(raw, uint16(len(m)))
+		copy(raw[2:], m)
+		_, err = f.WriteAt(raw, idx.PutOff)
+		require.NoError(t, err)
+		idx.PutOff += int64(len(raw))
+		idx.Count++
+		idx.Pending++
+	}
+	_, err = f.WriteAt(legacyIndex(idx), 0)
+	require.NoError(t, err)
+	mq.Close()
+
+	mq, err = NewQueue(dir, nil)
+	require.NoError(t, err)
+	defer mq.Close()
+
+	topic, err := mq.Get(3)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), topic.Pending())
+
+	err = topic.Put(make([]byte, 100<<10))
+	require.NoError(t, err)
+
+	b, err := topic.Peek()
+	require.NoError(t, err)
+	require.Equal(t, []byte("abc"), b)
+	err = topic.Drop(b)
+	require.NoError(t, err)
+
+	b, err = topic.Get()
+	require.NoError(t, err)
+	require.Equal(t, []byte("defg"), b)
+
+	b, err = topic.Get()
+	require.NoError(t, err)
+	require.Equal(t, make([]byte, 100<<10), b)
+}
+
+func TestMQBrokenMsg(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fhck-mq")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mq, err := NewQueue(dir, nil)
+	require.NoError(t, err)
+
+	topic, err := mq.Get(0)
+	require.NoError(t, err)
+
+	for _, m := range []string{"abc", "defg", "hijkl"} {
+		err = topic.Put([]byte(m))
+		require.NoError(t, err)
+	}
+
+	f, err := mq.vol.Open(0)
+	require.NoError(t, err)
+
+	// broken head is not returned
+	off := topic.idx.GetOff + frameSize(frameCRC|frameTime, 1)
+	_, err = f.WriteAt([]byte("x"), off)
+	require.NoError(t, err)
+	_, err = topic.Peek()
+	require.Equal(t, ErrBrokenMsg, err)
+	_, err = f.WriteAt([]byte("b"), off)
+	require.NoError(t, err)
+
+	// torn write of the last message
+	off = topic.idx.PutOff - 1
+	_, err = f.WriteAt([]byte("x"), off)
+	require.NoError(t, err)
+	mq.Close()
+
+	_, err = NewQueue(dir, &Config{Recover: false})
+	require.Equal(t, ErrBrokenMsg, err)
+
+	mq, err = NewQueue(dir, &Config{Recover: true})
+	require.NoError(t, err)
+	defer mq.Close()
+
+	topic, err = mq.Get(0)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), topic.Pending())
+	require.Equal(t, int64(2), topic.Count())
+
+	for _, m := range []string{"abc", "defg"} {
+		b, err := topic.Get()
+		require.NoError(t, err)
+		require.Equal(t, []byte(m), b)
+	}
+	_, err = topic.Get()
+	require.Equal(t, io.EOF, err)
+
+	// put after the last good message
+	err = topic.Put([]byte("xyz"))
+	require.NoError(t, err)
+	b, err := topic.Get()
+	require.NoError(t, err)
+	require.Equal(t, []byte("xyz"), b)
+}
+
+func TestMQZeroedMsg(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fhck-mq")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mq, err := NewQueue(dir, nil)
+	require.NoError(t, err)
+
+	topic, err := mq.Get(0)
+	require.NoError(t, err)
+
+	for _, m := range []string{"abc", "defg"} {
+		err = topic.Put([]byte(m))
+		require.NoError(t, err)
+	}
+
+	// lost page of a committed message reads as zeros
+	f, err := mq.vol.Open(0)
+	require.NoError(t, err)
+	n := frameSize(frameCRC|frameTime, 4)
+	_, err = f.WriteAt(make([]byte, n), topic.idx.PutOff-n)
+	require.NoError(t, err)
+	mq.Close()
+
+	mq, err = NewQueue(dir, &Config{Recover: true})
+	require.NoError(t, err)
+	defer mq.Close()
+
+	topic, err = mq.Get(0)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), topic.Count())
+	require.Equal(t, int64(1), topic.Pending())
+
+	b, err := topic.Get()
+	require.NoError(t, err)
+	require.Equal(t, []byte("abc"), b)
+	_, err = topic.Get()
+	require.Equal(t, io.EOF, err)
+}
+
+func TestMQTornIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fhck-mq")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mq, err := NewQueue(dir, nil)
+	require.NoError(t, err)
+
+	topic, err := mq.Get(0)
+	require.NoError(t, err)
+
+	err = topic.Put([]byte("abc"))
+	require.NoError(t, err)
+	err = topic.Put([]byte("defg"))
+	require.NoError(t, err)
+
+	// break the newest slot
+	f, err := mq.vol.Open(0)
+	require.NoError(t, err)
+	seq := topic.idx.Seq
+	_, err = f.WriteAt([]byte("xx"), metaOff+seq%2*slotSize+10)
+	require.NoError(t, err)
+	mq.Close()
+
+	// the previous slot is used
+	mq, err = NewQueue(dir, nil)
+	require.NoError(t, err)
+	defer mq.Close()
+
+	topic, err = mq.Get(0)
+	require.NoError(t, err)
+	require.Equal(t, seq, topic.idx.Seq) // reopen committed seq-1 + 1
+	require.Equal(t, int64(1), topic.Pending())
+	require.Equal(t, int64(1), topic.Count())
+
+	b, err := topic.Get()
+	require.NoError(t, err)
+	require.Equal(t, []byte("abc"), b)
+	_, err = topic.Get()
+	require.Equal(t, io.EOF, err)
+}
+
+func TestMQSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fhck-mq")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mq, err := NewQueue(dir, &Config{SyncPuts: 2, SyncInterval: time.Millisecond})
+	require.NoError(t, err)
+	defer mq.Close()
+
+	topic, err := mq.Get(0)
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		err = topic.Put([]byte("abc"))
+		require.NoError(t, err)
+		if i == 1 {
+			require.Equal(t, topic.idx, topic.synced)
+		}
+	}
+	require.Equal(t, 1, topic.puts)
+	require.NotEqual(t, topic.idx, topic.synced)
+
+	err = topic.PutWithKey([]byte("abc"), []byte("k"))
+	require.NoError(t, err)
+	require.Equal(t, topic.idx, topic.synced)
+
+	err = topic.Sync()
+	require.NoError(t, err)
+	err = mq.Sync()
+	require.NoError(t, err)
+
+	for i := 0; atomic.LoadInt64(&mq.syncs) == 0; i++ {
+		require.True(t, i < 100, "not synced")
+		time.Sleep(time.Millisecond)
+	}
+
+	mq.Close()
+	mq.Close()
+}
+
+func TestMQBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fhck-mq")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mq, err := NewQueue(dir, nil)
+	require.NoError(t, err)
+	defer mq.Close()
+
+	topic, err := mq.Get(0)
+	require.NoError(t, err)
+
+	_, err = topic.GetBatch(10)
+	require.Equal(t, io.EOF, err)
+
+	// all or nothing
+	err = topic.PutBatch([][]byte{[]byte("abc"), make([]byte, MaxMsgSize+1)})
+	require.Equal(t, ErrTooLargeMsg, err)
+	require.Equal(t, int64(0), topic.Count())
+
+	seq := topic.idx.Seq
+	err = topic.PutBatch([][]byte{[]byte("0"), []byte("1"), []byte("2")})
+	require.NoError(t, err)
+	require.Equal(t, seq+1, topic.idx.Seq)
+	require.Equal(t, int64(3), topic.Count())
+	require.Equal(t, int64(3), topic.Pending())
+
+	bs, err := topic.GetBatch(2)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("0"), []byte("1")}, bs)
+	require.Equal(t, seq+2, topic.idx.Seq)
+	require.Equal(t, int64(1), topic.Pending())
+
+	bs, err = topic.GetBatch(2)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("2")}, bs)
+	require.Equal(t, int64(0), topic.Pending())
+
+	_, err = topic.GetBatch(2)
+	require.Equal(t, io.EOF, err)
+
+	_, err = topic.GetBatch(0)
+	require.Equal(t, ErrInvalidMax, err)
+}
+
+func TestMQDelete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fhck-mq")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mq, err := NewQueue(dir, nil)
+	require.NoError(t, err)
+
+	topic, err := mq.GetByName("orders")
+	require.NoError(t, err)
+	id := topic.ID()
+
+	err = topic.Put(make([]byte, 1<<20))
+	require.NoError(t, err)
+	_, err = topic.Group("g")
+	require.NoError(t, err)
+
+	err = mq.Delete(id)
+	require.NoError(t, err)
+	err = mq.Delete(id)
+	require.NoError(t, err)
+	require.Equal(t, 0, len(mq.Topics()))
+	_, ok := mq.Lookup("orders")
+	require.False(t, ok)
+
+	_, err = topic.Get()
+	require.Equal(t, ErrDeletedTopic, err)
+	err = topic.Put([]byte("abc"))
+	require.Equal(t, ErrDeletedTopic, err)
+
+	// crashed after marked as deleted
+	t1, err := mq.Get(1)
+	require.NoError(t, err)
+	f, err := mq.vol.Open(1)
+	require.NoError(t, err)
+	newIdx := *t1.idx
+	newIdx.Flag |= flagDeleted
+	err = t1.commit(f, &newIdx)
+	require.NoError(t, err)
+
+	// crashed while releasing, all blocks except the index one are released
+	t2, err := mq.Get(2)
+	require.NoError(t, err)
+	err = t2.PutWithKey([]byte("k"), []byte("abc"))
+	require.NoError(t, err)
+	f, err = mq.vol.Open(2)
+	require.NoError(t, err)
+	newIdx = *t2.idx
+	newIdx.Flag |= flagDeleted
+	err = t2.commit(f, &newIdx)
+	require.NoError(t, err)
+	blk := int64(mq.vol.BlockSize)
+	f.Discard(0, metaOff)
+	f.Discard(metaOff+blk, math.MaxInt64-metaOff-blk)
+	mq.Close()
+
+	mq, err = NewQueue(dir, nil)
+	require.NoError(t, err)
+	defer mq.Close()
+
+	require.Equal(t, 0, len(mq.Topics()))
+	_, ok = mq.Lookup("orders")
+	require.False(t, ok)
+	require.Equal(t, 1, len(mq.vol.Files())) // registry only
+
+	// new topic with the same name
+	topic, err = mq.GetByName("orders")
+	require.NoError(t, err)
+	require.Equal(t, int64(0), topic.Count())
+}
+
+func TestMQGetContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fhck-mq")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mq, err := NewQueue(dir, nil)
+	require.NoError(t, err)
+	defer mq.Close()
+
+	topic, err := mq.Get(0)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = topic.GetContext(ctx)
+	require.Equal(t, context.DeadlineExceeded, err)
+
+	// waiters are woken up by put
+	peekc := make(chan []byte)
+	go func() {
+		b, _ := topic.PeekContext(context.Background())
+		peekc <- b
+	}()
+	time.Sleep(10 * time.Millisecond)
+	err = topic.Put([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("a"), <-peekc)
+
+	var wg sync.WaitGroup
+	res := make([][]byte, 3)
+	for i := range res {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res[i], _ = topic.GetContext(context.Background())
+		}(i)
+	}
+	time.Sleep(10 * time.Millisecond)
+	for _, m := range []string{"b", "c"} {
+		err = topic.Put([]byte(m))
+		require.NoError(t, err)
+	}
+	wg.Wait()
+	got := map[string]bool{}
+	for _, b := range res {
+		got[string(b)] = true
+	}
+	require.Equal(t, map[string]bool{"a": true, "b": true, "c": true}, got)
+
+	// waiters are woken up by close
+	errc := make(chan error)
+	go func() {
+		_, err := topic.GetContext(context.Background())
+		errc <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	err = topic.Close()
+	require.NoError(t, err)
+	require.Equal(t, ErrClosedTopic, <-errc)
+}
@@ -0,0 +1,362 @@
+package mqhttp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/justmao945/tama/mq"
+)
+
+// Client of a queue served by Handler.
+type Client struct {
+	addr string
+	hc   *http.Client
+}
+
+// NewClient returns a client of the queue served at addr, like http://localhost:8080.
+// http.DefaultClient is used if hc is nil.
+func NewClient(addr string, hc *http.Client) *Client {
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	return &Client{addr: strings.TrimRight(addr, "/"), hc: hc}
+}
+
+// do sends a request, the response is decoded to v if it's not nil, or returned as b.
+func (c *Client) do(ctx context.Context, method, path string, q url.Values, body []byte, v interface{}) (b []byte, err error) {
+	u := c.addr + path
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	if ctx != nil {
+		req = req.WithContext(ctx)
+	}
+
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	b, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		err = parseError(resp.StatusCode, b)
+		b = nil
+		return
+	}
+	if v != nil {
+		err = json.Unmarshal(b, v)
+	}
+	return
+}
+
+// parseError returns the known error with the same text.
+func parseError(code int, b []byte) error {
+	s := strings.TrimSpace(string(b))
+	for _, e := range errs {
+		if e.code == code && e.err.Error() == s {
+			return e.err
+		}
+	}
+	return errors.New(fmt.Sprint("mqhttp: ", code, " ", s))
+}
+
+// Topics returns topics opened by the server.
+func (c *Client) Topics() (res []Stat, err error) {
+	_, err = c.do(nil, "GET", "/topics", nil, nil, &res)
+	return
+}
+
+// Stats returns stats of topics opened by the server.
+func (c *Client) Stats() (res []Stat, err error) {
+	_, err = c.do(nil, "GET", "/stats", nil, nil, &res)
+	return
+}
+
+// Get returns a topic by id, will create a new one if is not exist.
+func (c *Client) Get(id uint32) (t *Topic, err error) {
+	var s Stat
+	_, err = c.do(nil, "POST", fmt.Sprint("/topics/", id, "/open"), nil, nil, &s)
+	if err != nil {
+		return
+	}
+	return c.topic(s), nil
+}
+
+// GetByName returns a topic by name, a new one is registered if it's not exist.
+func (c *Client) GetByName(name string) (t *Topic, err error) {
+	var s Stat
+	_, err = c.do(nil, "POST", "/topics", url.Values{"name": {name}}, nil, &s)
+	if err != nil {
+		return
+	}
+	return c.topic(s), nil
+}
+
+func (c *Client) topic(s Stat) *Topic {
+	t := &Topic{c: c, id: s.ID, name: s.Name}
+	t.def = &Group{t: t}
+	return t
+}
+
+// -------------------------------------------------------------------
+
+// Topic is a remote mq.Topic.
+type Topic struct {
+	c    *Client
+	id   uint32
+	name string
+	def  *Group
+}
+
+func (t *Topic) path(op string) string {
+	return fmt.Sprint("/topics/", t.id, "/", op)
+}
+
+// ID returns unique topic id
+func (t *Topic) ID() uint32 {
+	return t.id
+}
+
+// Name returns the registered name of this topic, empty if it's got by id.
+func (t *Topic) Name() string {
+	return t.name
+}
+
+// Stat returns stat of this topic.
+func (t *Topic) Stat() (s Stat, err error) {
+	return t.def.Stat()
+}
+
+// Count returns all message had been put to this topic, -1 if failed to request.
+func (t *Topic) Count() int64 {
+	s, err := t.Stat()
+	if err != nil {
+		return -1
+	}
+	return s.Count
+}
+
+// Pending returns messages can be get by the default group, -1 if failed to request.
+func (t *Topic) Pending() int64 {
+	return t.def.Pending()
+}
+
+// Group returns a consumer group of this topic, will create a new one if is not exist.
+func (t *Topic) Group(name string) (g *Group, err error) {
+	g = &Group{t: t, name: name}
+	_, err = g.do(nil, "POST", "open", nil, nil, nil)
+	if err != nil {
+		g = nil
+	}
+	return
+}
+
+// Close marks this topic as closed.
+func (t *Topic) Close() (err error) {
+	_, err = t.c.do(nil, "POST", t.path("close"), nil, nil, nil)
+	return
+}
+
+// Put a message to this topic.
+func (t *Topic) Put(b []byte) (err error) {
+	_, err = t.c.do(nil, "POST", t.path("put"), nil, b, nil)
+	return
+}
+
+// PutTTL puts a message which expires after ttl.
+func (t *Topic) PutTTL(b []byte, ttl time.Duration) (err error) {
+	_, err = t.c.do(nil, "POST", t.path("put"), url.Values{"ttl": {ttl.String()}}, b, nil)
+	return
+}
+
+// PutWithKey puts a message unless a message with the same key has been put within the dedup window.
+func (t *Topic) PutWithKey(key, b []byte) (err error) {
+	if len(key) == 0 {
+		err = mq.ErrInvalidKey
+		return
+	}
+	_, err = t.c.do(nil, "POST", t.path("put"), url.Values{"key": {string(key)}}, b, nil)
+	return
+}
+
+// PutBatch puts messages to this topic, either all messages are put or none of them.
+func (t *Topic) PutBatch(bs [][]byte) (err error) {
+	body, err := json.Marshal(bs)
+	if err != nil {
+		return
+	}
+	_, err = t.c.do(nil, "POST", t.path("putbatch"), nil, body, nil)
+	return
+}
+
+// Peek only returns the message, won't drop it.
+func (t *Topic) Peek() ([]byte, error) {
+	return t.def.Peek()
+}
+
+// PeekContext returns the message like Peek, but waits until a message is put, the topic is closed
+// or ctx is done.
+func (t *Topic) PeekContext(ctx context.Context) ([]byte, error) {
+	return t.def.PeekContext(ctx)
+}
+
+// Drop should only be called after Peek and with the right message.
+func (t *Topic) Drop(b []byte) error {
+	return t.def.Drop(b)
+}
+
+// Get returns a message in topic and drop it.
+func (t *Topic) Get() ([]byte, error) {
+	return t.def.Get()
+}
+
+// GetContext returns a message and drop it like Get, but waits until a message is put, the topic
+// is closed or ctx is done.
+func (t *Topic) GetContext(ctx context.Context) ([]byte, error) {
+	return t.def.GetContext(ctx)
+}
+
+// GetBatch returns at most max messages in topic and drop them.
+func (t *Topic) GetBatch(max int) ([][]byte, error) {
+	return t.def.GetBatch(max)
+}
+
+// Receive returns a message of the default group, see mq.Group.Receive.
+func (t *Topic) Receive(timeout time.Duration) (*mq.Message, error) {
+	return t.def.Receive(timeout)
+}
+
+// Ack removes a received message from the default group.
+func (t *Topic) Ack(r mq.Receipt) error {
+	return t.def.Ack(r)
+}
+
+// Nack makes a received message visible to receivers of the default group again.
+func (t *Topic) Nack(r mq.Receipt) error {
+	return t.def.Nack(r)
+}
+
+// -------------------------------------------------------------------
+
+// Group is a remote mq.Group, the default group has an empty name.
+type Group struct {
+	t    *Topic
+	name string
+}
+
+func (g *Group) query(q url.Values) url.Values {
+	if g.name == "" {
+		return q
+	}
+	if q == nil {
+		q = url.Values{}
+	}
+	q.Set("group", g.name)
+	return q
+}
+
+func (g *Group) do(ctx context.Context, method, op string, q url.Values, body []byte, v interface{}) ([]byte, error) {
+	return g.t.c.do(ctx, method, g.t.path(op), g.query(q), body, v)
+}
+
+// Name returns the group name, empty for the default group.
+func (g *Group) Name() string {
+	return g.name
+}
+
+// Topic returns the topic this group belongs to.
+func (g *Group) Topic() *Topic {
+	return g.t
+}
+
+// Stat returns stat of the topic with pending messages of this group.
+func (g *Group) Stat() (s Stat, err error) {
+	_, err = g.do(nil, "GET", "stats", nil, nil, &s)
+	return
+}
+
+// Pending returns messages can be get by this group, -1 if failed to request.
+func (g *Group) Pending() int64 {
+	s, err := g.Stat()
+	if err != nil {
+		return -1
+	}
+	return s.Pending
+}
+
+// Peek only returns the message, won't drop it.
+func (g *Group) Peek() ([]byte, error) {
+	return g.do(nil, "GET", "peek", nil, nil, nil)
+}
+
+// PeekContext returns the message like Peek, but waits until a message is put, the topic is closed
+// or ctx is done.
+func (g *Group) PeekContext(ctx context.Context) ([]byte, error) {
+	return g.do(ctx, "GET", "peek", url.Values{"wait": {"1"}}, nil, nil)
+}
+
+// Drop should only be called after Peek and with the right message.
+func (g *Group) Drop(b []byte) (err error) {
+	_, err = g.do(nil, "POST", "drop", nil, b, nil)
+	return
+}
+
+// Get returns a message in topic and drop it from this group.
+func (g *Group) Get() ([]byte, error) {
+	return g.do(nil, "POST", "get", nil, nil, nil)
+}
+
+// GetContext returns a message and drop it like Get, but waits until a message is put, the topic
+// is closed or ctx is done.
+func (g *Group) GetContext(ctx context.Context) ([]byte, error) {
+	return g.do(ctx, "POST", "get", url.Values{"wait": {"1"}}, nil, nil)
+}
+
+// GetBatch returns at most max messages in topic and drop them from this group.
+func (g *Group) GetBatch(max int) (bs [][]byte, err error) {
+	_, err = g.do(nil, "POST", "getbatch", url.Values{"max": {fmt.Sprint(max)}}, nil, &bs)
+	return
+}
+
+// Receive returns a message and hides it from other receivers for timeout, see mq.Group.Receive.
+func (g *Group) Receive(timeout time.Duration) (m *mq.Message, err error) {
+	var msg message
+	_, err = g.do(nil, "POST", "receive", url.Values{"timeout": {timeout.String()}}, nil, &msg)
+	if err != nil {
+		return
+	}
+	r, err := mq.ParseReceipt(msg.Receipt)
+	if err != nil {
+		return
+	}
+	m = &mq.Message{Data: msg.Data, Receipt: r, Attempts: msg.Attempts}
+	return
+}
+
+// Ack removes a received message from this group.
+func (g *Group) Ack(r mq.Receipt) (err error) {
+	_, err = g.do(nil, "POST", "ack", url.Values{"receipt": {r.String()}}, nil, nil)
+	return
+}
+
+// Nack makes a received message visible to receivers again immediately.
+func (g *Group) Nack(r mq.Receipt) (err error) {
+	_, err = g.do(nil, "POST", "nack", url.Values{"receipt": {r.String()}}, nil, nil)
+	return
+}
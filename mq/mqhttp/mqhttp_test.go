@@ -0,0 +1,168 @@
+package mqhttp
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/justmao945/tama/mq"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fhck-mqhttp")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	q, err := mq.NewQueue(dir, nil)
+	require.NoError(t, err)
+	defer q.Close()
+
+	srv := httptest.NewServer(NewHandler(q))
+	defer srv.Close()
+	c := NewClient(srv.URL, nil)
+
+	topic, err := c.GetByName("foo")
+	require.NoError(t, err)
+	require.Equal(t, "foo", topic.Name())
+
+	_, err = topic.Get()
+	require.Equal(t, io.EOF, err)
+
+	err = topic.Put([]byte("a"))
+	require.NoError(t, err)
+	err = topic.PutBatch([][]byte{[]byte("b"), []byte("c")})
+	require.NoError(t, err)
+	err = topic.PutWithKey([]byte("k"), []byte("d"))
+	require.NoError(t, err)
+	err = topic.PutWithKey([]byte("k"), []byte("d"))
+	require.Equal(t, mq.ErrDuplicateMsg, err)
+	_, err = c.do(nil, "POST", topic.path("put"), url.Values{"key": {"k2"}, "ttl": {"1s"}}, []byte("e"), nil)
+	require.Error(t, err)
+	require.Equal(t, int64(4), topic.Count())
+
+	g, err := topic.Group("g")
+	require.NoError(t, err)
+	require.Equal(t, int64(4), g.Pending())
+
+	b, err := topic.Peek()
+	require.NoError(t, err)
+	require.Equal(t, []byte("a"), b)
+	err = topic.Drop(b)
+	require.NoError(t, err)
+
+	b, err = topic.Get()
+	require.NoError(t, err)
+	require.Equal(t, []byte("b"), b)
+
+	bs, err := topic.GetBatch(10)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("c"), []byte("d")}, bs)
+	require.Equal(t, int64(0), topic.Pending())
+	_, err = topic.GetBatch(0)
+	require.Equal(t, mq.ErrInvalidMax, err)
+
+	// group is independent
+	m, err := g.Receive(time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, []byte("a"), m.Data)
+	require.Equal(t, 1, m.Attempts)
+	err = g.Nack(m.Receipt)
+	require.NoError(t, err)
+	m, err = g.Receive(time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, 2, m.Attempts)
+	err = g.Ack(m.Receipt)
+	require.NoError(t, err)
+	err = g.Ack(m.Receipt)
+	require.Equal(t, mq.ErrInvalidReceipt, err)
+	require.Equal(t, int64(3), g.Pending())
+
+	// wait for put
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		topic.Put([]byte("e"))
+	}()
+	b, err = topic.GetContext(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []byte("e"), b)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = topic.PeekContext(ctx)
+	require.Error(t, err)
+
+	ts, err := c.Topics()
+	require.NoError(t, err)
+	require.Equal(t, []Stat{{ID: topic.ID(), Name: "foo"}}, ts)
+
+	ss, err := c.Stats()
+	require.NoError(t, err)
+	require.Equal(t, []Stat{{ID: topic.ID(), Name: "foo", Count: 5}}, ss)
+
+	t2, err := c.Get(topic.ID())
+	require.NoError(t, err)
+	require.Equal(t, "foo", t2.Name())
+
+	err = topic.Close()
+	require.NoError(t, err)
+	err = topic.Put([]byte("f"))
+	require.Equal(t, mq.ErrClosedTopic, err)
+	_, err = topic.Get()
+	require.Equal(t, mq.ErrClosedTopic, err)
+}
+
+func TestReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fhck-mqhttp")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	q, err := mq.NewQueue(dir, nil)
+	require.NoError(t, err)
+	defer q.Close()
+
+	h := NewHandler(q)
+	h.maxMsg, h.maxBatch = 4, 16
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	c := NewClient(srv.URL, nil)
+
+	// GET requests never create topics or groups
+	topic := c.topic(Stat{ID: 1})
+	_, err = topic.Stat()
+	require.Equal(t, ErrTopicNotFound, err)
+	_, err = topic.Peek()
+	require.Equal(t, ErrTopicNotFound, err)
+	require.Len(t, q.Topics(), 0)
+
+	topic, err = c.Get(1)
+	require.NoError(t, err)
+	require.Len(t, q.Topics(), 1)
+
+	g := &Group{t: topic, name: "g"}
+	_, err = g.Stat()
+	require.Equal(t, ErrGroupNotFound, err)
+	_, err = g.Peek()
+	require.Equal(t, ErrGroupNotFound, err)
+	mt, _ := q.Find(1)
+	require.Len(t, mt.Groups(), 0)
+
+	g, err = topic.Group("g")
+	require.NoError(t, err)
+	require.Len(t, mt.Groups(), 1)
+	_, err = g.Peek()
+	require.Equal(t, io.EOF, err)
+
+	// body size is limited
+	require.NoError(t, topic.Put([]byte("1234")))
+	require.Equal(t, mq.ErrTooLargeMsg, topic.Put([]byte("12345")))
+	require.NoError(t, topic.PutBatch([][]byte{[]byte("a")}))
+	require.Equal(t, mq.ErrTooLargeMsg, topic.PutBatch([][]byte{[]byte("1234"), []byte("5678")}))
+	require.Equal(t, mq.ErrTooLargeMsg, topic.Drop([]byte("12345")))
+	require.Equal(t, int64(2), topic.Count())
+}
@@ -0,0 +1,364 @@
+// Package mqhttp serves a mq.Queue over HTTP, and provides a client with the same method set of
+// mq.Topic, so topics can be used remotely.
+package mqhttp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/justmao945/tama/mq"
+)
+
+// MaxBatchSize is the max body size of putbatch, a JSON array of base64 encoded messages.
+const MaxBatchSize = 2 * mq.MaxMsgSize
+
+var (
+	// ErrTopicNotFound indicates a read only request to a topic not exist.
+	ErrTopicNotFound = errors.New("topic not found")
+
+	// ErrGroupNotFound indicates a read only request to a group not exist.
+	ErrGroupNotFound = errors.New("group not found")
+)
+
+// Stat of a topic or a group.
+type Stat struct {
+	ID      uint32 `json:"id"`
+	Name    string `json:"name"`
+	Count   int64  `json:"count"`
+	Pending int64  `json:"pending"`
+}
+
+// message is a received message.
+type message struct {
+	Data     []byte `json:"data"`
+	Receipt  string `json:"receipt"`
+	Attempts int    `json:"attempts"`
+}
+
+// reader is implemented by both mq.Topic and mq.Group.
+type reader interface {
+	Get() ([]byte, error)
+	GetContext(ctx context.Context) ([]byte, error)
+	GetBatch(max int) ([][]byte, error)
+	Peek() ([]byte, error)
+	PeekContext(ctx context.Context) ([]byte, error)
+	Drop(b []byte) error
+	Receive(timeout time.Duration) (*mq.Message, error)
+	Ack(r mq.Receipt) error
+	Nack(r mq.Receipt) error
+	Pending() int64
+}
+
+// Handler serves a queue over HTTP:
+//
+//	GET  /topics                  list opened topics
+//	POST /topics?name=            get or register a topic by name
+//	GET  /stats                   stats of opened topics
+//	GET  /topics/{id}/stats       stats of a topic
+//	POST /topics/{id}/open        get or create a topic, and the group if group is set, returns stats
+//	POST /topics/{id}/put         put body, with optional ttl or key
+//	POST /topics/{id}/putbatch    put a JSON array of messages
+//	POST /topics/{id}/close       close a topic
+//	POST /topics/{id}/get         get a message, wait=1 to wait until a message is put
+//	POST /topics/{id}/getbatch    get at most max messages
+//	GET  /topics/{id}/peek        peek a message, wait=1 to wait until a message is put
+//	POST /topics/{id}/drop        drop body after peek
+//	POST /topics/{id}/receive     receive a message with timeout
+//	POST /topics/{id}/ack         ack a receipt
+//	POST /topics/{id}/nack        nack a receipt
+//
+// Messages are read from the default group, or the group named by group. Only POST requests
+// create topics and groups, GET requests return 404 if they are not exist. Errors are returned
+// as plain text with status code, see errs.
+type Handler struct {
+	q        *mq.Queue
+	maxMsg   int64 // max body size of put and drop
+	maxBatch int64 // max body size of putbatch
+}
+
+// NewHandler returns a handler serving q.
+func NewHandler(q *mq.Queue) *Handler {
+	return &Handler{q: q, maxMsg: mq.MaxMsgSize, maxBatch: MaxBatchSize}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "topics":
+		h.topics(w, r)
+	case len(parts) == 1 && parts[0] == "stats":
+		h.stats(w, r)
+	case len(parts) == 3 && parts[0] == "topics":
+		h.topic(w, r, parts[1], parts[2])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *Handler) topics(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		res := []Stat{}
+		for _, t := range h.q.Topics() {
+			res = append(res, Stat{ID: t.ID(), Name: t.Name()})
+		}
+		writeJSON(w, res)
+	case "POST":
+		t, err := h.q.GetByName(r.FormValue("name"))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, Stat{ID: t.ID(), Name: t.Name()})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) stats(w http.ResponseWriter, r *http.Request) {
+	res := []Stat{}
+	for _, t := range h.q.Topics() {
+		res = append(res, stat(t, t))
+	}
+	writeJSON(w, res)
+}
+
+func stat(t *mq.Topic, rd reader) Stat {
+	return Stat{ID: t.ID(), Name: t.Name(), Count: t.Count(), Pending: rd.Pending()}
+}
+
+// methods of topic operations, only POST ones create topics and groups.
+var methods = map[string]string{
+	"stats":    "GET",
+	"peek":     "GET",
+	"open":     "POST",
+	"put":      "POST",
+	"putbatch": "POST",
+	"close":    "POST",
+	"get":      "POST",
+	"getbatch": "POST",
+	"drop":     "POST",
+	"receive":  "POST",
+	"ack":      "POST",
+	"nack":     "POST",
+}
+
+func (h *Handler) topic(w http.ResponseWriter, r *http.Request, sid, op string) {
+	id, err := strconv.ParseUint(sid, 10, 32)
+	if err != nil {
+		http.Error(w, "invalid topic id", http.StatusBadRequest)
+		return
+	}
+	method, ok := methods[op]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != method {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	t, rd, err := h.reader(r, uint32(id))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	wait := r.FormValue("wait") == "1"
+
+	var b []byte
+	switch op {
+	case "stats", "open":
+		writeJSON(w, stat(t, rd))
+		return
+	case "put":
+		if r.FormValue("key") != "" && r.FormValue("ttl") != "" {
+			http.Error(w, "key and ttl can not be used together", http.StatusBadRequest)
+			return
+		}
+		b, err = readBody(w, r, h.maxMsg)
+		if err != nil {
+			break
+		}
+		if key := r.FormValue("key"); key != "" {
+			err = t.PutWithKey([]byte(key), b)
+		} else if ttl := r.FormValue("ttl"); ttl != "" {
+			var d time.Duration
+			d, err = time.ParseDuration(ttl)
+			if err != nil {
+				http.Error(w, "invalid ttl", http.StatusBadRequest)
+				return
+			}
+			err = t.PutTTL(b, d)
+		} else {
+			err = t.Put(b)
+		}
+		b = nil
+	case "putbatch":
+		var bs [][]byte
+		err = json.NewDecoder(http.MaxBytesReader(w, r.Body, h.maxBatch)).Decode(&bs)
+		if _, ok := err.(*http.MaxBytesError); ok {
+			err = mq.ErrTooLargeMsg
+			break
+		}
+		if err != nil {
+			http.Error(w, "invalid batch", http.StatusBadRequest)
+			return
+		}
+		err = t.PutBatch(bs)
+	case "close":
+		err = t.Close()
+	case "get":
+		if wait {
+			b, err = rd.GetContext(r.Context())
+		} else {
+			b, err = rd.Get()
+		}
+	case "getbatch":
+		max, err1 := strconv.Atoi(r.FormValue("max"))
+		if err1 != nil {
+			http.Error(w, "invalid max", http.StatusBadRequest)
+			return
+		}
+		var bs [][]byte
+		bs, err = rd.GetBatch(max)
+		if err == nil {
+			writeJSON(w, bs)
+			return
+		}
+	case "peek":
+		if wait {
+			b, err = rd.PeekContext(r.Context())
+		} else {
+			b, err = rd.Peek()
+		}
+	case "drop":
+		b, err = readBody(w, r, h.maxMsg)
+		if err != nil {
+			break
+		}
+		err = rd.Drop(b)
+		b = nil
+	case "receive":
+		timeout, err1 := time.ParseDuration(r.FormValue("timeout"))
+		if err1 != nil {
+			http.Error(w, "invalid timeout", http.StatusBadRequest)
+			return
+		}
+		var m *mq.Message
+		m, err = rd.Receive(timeout)
+		if err == nil {
+			writeJSON(w, message{Data: m.Data, Receipt: m.Receipt.String(), Attempts: m.Attempts})
+			return
+		}
+	case "ack", "nack":
+		var rc mq.Receipt
+		rc, err = mq.ParseReceipt(r.FormValue("receipt"))
+		if err != nil {
+			break
+		}
+		if op == "ack" {
+			err = rd.Ack(rc)
+		} else {
+			err = rd.Nack(rc)
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(b)
+}
+
+// reader returns the topic and the group to read, they are created by POST requests only.
+func (h *Handler) reader(r *http.Request, id uint32) (t *mq.Topic, rd reader, err error) {
+	name := r.FormValue("group")
+	if r.Method == "POST" {
+		t, err = h.q.Get(id)
+		if err != nil {
+			return
+		}
+		rd = t
+		if name != "" {
+			rd, err = t.Group(name)
+		}
+		return
+	}
+
+	t, ok := h.q.Find(id)
+	if !ok {
+		err = ErrTopicNotFound
+		return
+	}
+	rd = t
+	if name != "" {
+		g, ok := t.FindGroup(name)
+		if !ok {
+			err = ErrGroupNotFound
+			return
+		}
+		rd = g
+	}
+	return
+}
+
+// readBody reads the request body, ErrTooLargeMsg is returned if it's larger than max.
+func readBody(w http.ResponseWriter, r *http.Request, max int64) (b []byte, err error) {
+	b, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, max))
+	if _, ok := err.(*http.MaxBytesError); ok {
+		err = mq.ErrTooLargeMsg
+	}
+	return
+}
+
+// errs are errors returned as is to clients.
+var errs = []struct {
+	err  error
+	code int
+}{
+	{io.EOF, http.StatusNotFound},
+	{ErrTopicNotFound, http.StatusNotFound},
+	{ErrGroupNotFound, http.StatusNotFound},
+	{mq.ErrClosedTopic, http.StatusGone},
+	{mq.ErrDeletedTopic, http.StatusGone},
+	{mq.ErrDuplicateMsg, http.StatusConflict},
+	{mq.ErrTooLargeMsg, http.StatusRequestEntityTooLarge},
+	{mq.ErrInvalidMsg, http.StatusBadRequest},
+	{mq.ErrInvalidKey, http.StatusBadRequest},
+	{mq.ErrInvalidGroup, http.StatusBadRequest},
+	{mq.ErrInvalidMax, http.StatusBadRequest},
+	{mq.ErrInvalidReceipt, http.StatusBadRequest},
+	{mq.ErrInvalidPosition, http.StatusBadRequest},
+	{mq.ErrReservedTopic, http.StatusBadRequest},
+	{mq.ErrBrokenMsg, http.StatusInternalServerError},
+	{mq.ErrBrokenIndex, http.StatusInternalServerError},
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	for _, e := range errs {
+		if e.err == err {
+			code = e.code
+			break
+		}
+	}
+	http.Error(w, err.Error(), code)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,102 @@
+package mq
+
+import (
+	"sort"
+
+	"github.com/justmao945/tama/wildcard"
+)
+
+// Subscribe saves pattern as a subscription, publishes to it are put to all topics with matched
+// names, including topics registered later. Patterns are matched by wildcard.Match.
+func (q *Queue) Subscribe(pattern string) (err error) {
+	if pattern == "" || len(pattern) > MaxTopicName {
+		err = ErrInvalidTopic
+		return
+	}
+
+	q.l.Lock()
+	defer q.l.Unlock()
+
+	if _, ok := q.reg.subs[pattern]; ok {
+		return
+	}
+
+	f, err := q.vol.Open(registryFd)
+	if err != nil {
+		return
+	}
+	return q.reg.add(f, 0, recordPattern, pattern)
+}
+
+// Unsubscribe removes a subscription.
+func (q *Queue) Unsubscribe(pattern string) (err error) {
+	q.l.Lock()
+	defer q.l.Unlock()
+
+	if _, ok := q.reg.subs[pattern]; !ok {
+		return
+	}
+
+	f, err := q.vol.Open(registryFd)
+	if err != nil {
+		return
+	}
+	return q.reg.add(f, 0, recordPattern|recordDeleted, pattern)
+}
+
+// Subscriptions returns all subscription patterns in order.
+func (q *Queue) Subscriptions() (res []string) {
+	q.l.RLock()
+	defer q.l.RUnlock()
+
+	for p := range q.reg.subs {
+		res = append(res, p)
+	}
+	sort.Strings(res)
+	return
+}
+
+// Publish puts b to all topics with names matched by pattern atomically, returns the number of
+// topics, nothing is put if any of them is closed. Names are matched on each call, or kept by
+// the subscription if pattern is subscribed.
+func (q *Queue) Publish(pattern string, b []byte) (n int, err error) {
+	if pattern == "" || len(pattern) > MaxTopicName {
+		err = ErrInvalidTopic
+		return
+	}
+
+	q.l.RLock()
+	var ids []uint32
+	if subs, ok := q.reg.subs[pattern]; ok {
+		for id := range subs {
+			ids = append(ids, id)
+		}
+	} else {
+		for name, id := range q.reg.names {
+			if wildcard.Match(name, pattern) {
+				ids = append(ids, id)
+			}
+		}
+	}
+	q.l.RUnlock()
+
+	tx := q.Txn()
+	for _, id := range ids {
+		var t *Topic
+		t, err = q.Get(id)
+		if err != nil {
+			return
+		}
+		err = tx.Put(t, b)
+		if err != nil {
+			return
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return
+	}
+	n = len(ids)
+	return
+}
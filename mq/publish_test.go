@@ -0,0 +1,95 @@
+package mq
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublish(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fhck-mq")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mq, err := NewQueue(dir, nil)
+	require.NoError(t, err)
+
+	for _, name := range []string{"orders.eu", "orders.us", "users"} {
+		_, err = mq.GetByName(name)
+		require.NoError(t, err)
+	}
+
+	// existing names without subscription
+	n, err := mq.Publish("orders.*", []byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	require.Nil(t, mq.Subscriptions())
+
+	err = mq.Subscribe("orders.*")
+	require.NoError(t, err)
+	require.Equal(t, []string{"orders.*"}, mq.Subscriptions())
+
+	// topics registered later
+	err = mq.Subscribe("users.?")
+	require.NoError(t, err)
+	_, err = mq.GetByName("orders.cn")
+	require.NoError(t, err)
+	_, err = mq.GetByName("users.1")
+	require.NoError(t, err)
+
+	n, err = mq.Publish("orders.*", []byte("b"))
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+	n, err = mq.Publish("users.?", []byte("c"))
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	mq.Close()
+
+	// subscriptions are persisted
+	mq, err = NewQueue(dir, nil)
+	require.NoError(t, err)
+	defer mq.Close()
+
+	require.Equal(t, []string{"orders.*", "users.?"}, mq.Subscriptions())
+	require.Equal(t, 3, len(mq.reg.subs["orders.*"]))
+
+	get := func(name string) (res []string) {
+		topic, err := mq.GetByName(name)
+		require.NoError(t, err)
+		for {
+			b, err := topic.Get()
+			if err == io.EOF {
+				return
+			}
+			require.NoError(t, err)
+			res = append(res, string(b))
+		}
+	}
+	require.Equal(t, []string{"a", "b"}, get("orders.eu"))
+	require.Equal(t, []string{"a", "b"}, get("orders.us"))
+	require.Equal(t, []string{"b"}, get("orders.cn"))
+	require.Equal(t, []string{"c"}, get("users.1"))
+	require.Nil(t, get("users"))
+
+	id, _ := mq.Lookup("orders.us")
+	err = mq.Delete(id)
+	require.NoError(t, err)
+	n, err = mq.Publish("orders.*", []byte("d"))
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+
+	err = mq.Unsubscribe("users.?")
+	require.NoError(t, err)
+	require.Equal(t, []string{"orders.*"}, mq.Subscriptions())
+	n, err = mq.Publish("users.?", []byte("x"))
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	_, err = mq.Publish("", []byte("x"))
+	require.Equal(t, ErrInvalidTopic, err)
+	err = mq.Subscribe("")
+	require.Equal(t, ErrInvalidTopic, err)
+}
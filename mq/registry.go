@@ -0,0 +1,140 @@
+package mq
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"math"
+
+	"github.com/justmao945/tama/mfs"
+	"github.com/justmao945/tama/wildcard"
+)
+
+// Files with fd >= reservedFd are used by queue itself, not topics.
+const (
+	reservedFd = math.MaxUint32 - 15
+	registryFd = math.MaxUint32 // topic names
+)
+
+// MaxTopicName is the max length of a topic name.
+const MaxTopicName = 255
+
+const (
+	recordHeaderSize = 12 // crc 4B | id 4B | flag 2B | len 2B
+)
+
+const (
+	recordDeleted = 1 << iota // name is removed
+	recordPattern             // name is a subscription pattern, id is unused
+)
+
+var (
+	// ErrReservedTopic indicates the topic id is reserved by queue.
+	ErrReservedTopic = errors.New("reserved topic")
+
+	// ErrInvalidTopic indicates the topic name is empty or too long.
+	ErrInvalidTopic = errors.New("invalid topic name")
+)
+
+// registry maps topic names to ids, and keeps subscription patterns, saved as appended records
+// in the registry file:
+//
+//	| crc 4B | id 4B | flag 2B | len 2B | name | ...
+type registry struct {
+	names map[string]uint32
+	ids   map[uint32]string
+	subs  map[string]map[uint32]bool // subscription pattern to ids of matched names
+	off   int64                      // append records here
+}
+
+// loadRegistry reads all records until the end or a torn one.
+func loadRegistry(f *mfs.File) (r *registry, err error) {
+	r = &registry{
+		names: make(map[string]uint32),
+		ids:   make(map[uint32]string),
+		subs:  make(map[string]map[uint32]bool),
+	}
+	for {
+		hdr := make([]byte, recordHeaderSize)
+		_, err = f.ReadAt(hdr, r.off)
+		if err == io.EOF {
+			err = nil
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		name := make([]byte, binary.LittleEndian.Uint16(hdr[10:]))
+		_, err = f.ReadAt(name, r.off+recordHeaderSize)
+		if err == io.EOF {
+			err = nil
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		crc := crc32.ChecksumIEEE(hdr[4:])
+		crc = crc32.Update(crc, crc32.IEEETable, name)
+		if len(name) == 0 || crc != binary.LittleEndian.Uint32(hdr) { // torn record
+			return
+		}
+
+		r.set(binary.LittleEndian.Uint32(hdr[4:]), binary.LittleEndian.Uint16(hdr[8:]), string(name))
+		r.off += recordHeaderSize + int64(len(name))
+	}
+}
+
+func (r *registry) set(id uint32, flag uint16, name string) {
+	if flag&recordPattern != 0 {
+		if flag&recordDeleted != 0 {
+			delete(r.subs, name)
+			return
+		}
+		ids := make(map[uint32]bool)
+		for n, id := range r.names {
+			if wildcard.Match(n, name) {
+				ids[id] = true
+			}
+		}
+		r.subs[name] = ids
+		return
+	}
+
+	if flag&recordDeleted != 0 {
+		delete(r.names, name)
+		delete(r.ids, id)
+		for _, ids := range r.subs {
+			delete(ids, id)
+		}
+		return
+	}
+	r.names[name] = id
+	r.ids[id] = name
+	for p, ids := range r.subs {
+		if wildcard.Match(name, p) {
+			ids[id] = true
+		}
+	}
+}
+
+// add appends a record of name to the registry file.
+func (r *registry) add(f *mfs.File, id uint32, flag uint16, name string) (err error) {
+	b := make([]byte, recordHeaderSize+len(name))
+	binary.LittleEndian.PutUint32(b[4:], id)
+	binary.LittleEndian.PutUint16(b[8:], flag)
+	binary.LittleEndian.PutUint16(b[10:], uint16(len(name)))
+	copy(b[recordHeaderSize:], name)
+	binary.LittleEndian.PutUint32(b, crc32.ChecksumIEEE(b[4:]))
+
+	_, err = f.WriteAt(b, r.off)
+	if err != nil {
+		return
+	}
+
+	r.set(id, flag, name)
+	r.off += int64(len(b))
+	return
+}
@@ -0,0 +1,71 @@
+package mq
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fhck-mq")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mq, err := NewQueue(dir, nil)
+	require.NoError(t, err)
+
+	_, err = mq.Get(math.MaxUint32)
+	require.Equal(t, ErrReservedTopic, err)
+	_, err = mq.GetByName("")
+	require.Equal(t, ErrInvalidTopic, err)
+
+	t3, err := mq.Get(3)
+	require.NoError(t, err)
+
+	_, ok := mq.Lookup("orders")
+	require.False(t, ok)
+
+	orders, err := mq.GetByName("orders")
+	require.NoError(t, err)
+	require.Equal(t, uint32(4), orders.ID())
+	require.Equal(t, "orders", orders.Name())
+
+	id, ok := mq.Lookup("orders")
+	require.True(t, ok)
+	require.Equal(t, uint32(4), id)
+
+	t1, err := mq.GetByName("orders")
+	require.NoError(t, err)
+	require.Equal(t, orders, t1)
+
+	err = orders.Put([]byte("abc"))
+	require.NoError(t, err)
+
+	users, err := mq.GetByName("users")
+	require.NoError(t, err)
+	require.Equal(t, uint32(5), users.ID())
+
+	require.Equal(t, []*Topic{t3, orders, users}, mq.Topics())
+	mq.Close()
+
+	// names are persisted
+	mq, err = NewQueue(dir, nil)
+	require.NoError(t, err)
+	defer mq.Close()
+
+	topics := mq.Topics()
+	require.Equal(t, 3, len(topics))
+	require.Equal(t, "", topics[0].Name())
+	require.Equal(t, "orders", topics[1].Name())
+	require.Equal(t, "users", topics[2].Name())
+
+	orders, err = mq.GetByName("orders")
+	require.NoError(t, err)
+	require.Equal(t, uint32(4), orders.ID())
+	b, err := orders.Get()
+	require.NoError(t, err)
+	require.Equal(t, []byte("abc"), b)
+}
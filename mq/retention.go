@@ -0,0 +1,92 @@
+package mq
+
+import (
+	"time"
+
+	"github.com/justmao945/tama/mfs"
+)
+
+// Retention limits messages retained by a topic, zero means no limit.
+// Messages exceeding any limit are dropped from all groups, even if they are not consumed.
+type Retention struct {
+	MaxBytes int64         // max size of messages after the slowest group
+	MaxAge   time.Duration // max duration since a message is put
+}
+
+// Retention returns the retention limits of this topic.
+func (t *Topic) Retention() Retention {
+	t.l.RLock()
+	defer t.l.RUnlock()
+
+	return Retention{MaxBytes: t.ret.MaxBytes, MaxAge: time.Duration(t.ret.MaxAge)}
+}
+
+// SetRetention saves the retention limits of this topic and drops messages exceeding them.
+func (t *Topic) SetRetention(r Retention) (err error) {
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	f, err := t.file()
+	if err != nil {
+		return
+	}
+
+	ri := &retentionIndex{MaxBytes: r.MaxBytes, MaxAge: int64(r.MaxAge), Seq: t.ret.Seq + 1}
+	_, err = f.WriteAt(encodeSlot(ri), retentionOff+ri.Seq%2*slotSize)
+	if err != nil {
+		return
+	}
+	t.ret = ri
+
+	return t.retain(f)
+}
+
+// expired returns true if the message is expired by its ttl or max age of this topic at now.
+// Legacy messages have no put time and never expire.
+func (t *Topic) expired(fr *frame, now int64) bool {
+	if fr.deadline != 0 && now >= fr.deadline {
+		return true
+	}
+	return t.ret.MaxAge > 0 && fr.time != 0 && now-fr.time > t.ret.MaxAge
+}
+
+// retain drops messages at head exceeding retention limits or expired from all groups,
+// then reclaims their storage.
+func (t *Topic) retain(f *mfs.File) (err error) {
+	now := time.Now().UnixNano()
+	s := t.slowest()
+	off, next := s.off(), s.next()
+	for off < t.idx.PutOff {
+		fr, err1 := readFrameHeader(f, off, off < t.idx.LegacyEnd)
+		if err1 != nil || off+fr.n > t.idx.PutOff { // reported by get
+			break
+		}
+		over := t.ret.MaxBytes > 0 && t.idx.PutOff-off > t.ret.MaxBytes
+		if !over && !t.expired(fr, now) {
+			break
+		}
+		off += fr.n
+		next++
+	}
+	if off == s.off() {
+		return
+	}
+
+	for _, g := range t.groups {
+		if g.off() < off {
+			err = g.commit(f, off, next)
+			if err != nil {
+				return
+			}
+		}
+	}
+	if t.follows() == nil && t.def.off() < off {
+		err = t.def.commit(f, off, next)
+		if err != nil {
+			return
+		}
+	}
+
+	t.reclaim(f)
+	return
+}
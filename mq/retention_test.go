@@ -0,0 +1,180 @@
+package mq
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTTL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fhck-mq")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mq, err := NewQueue(dir, nil)
+	require.NoError(t, err)
+	defer mq.Close()
+
+	topic, err := mq.Get(0)
+	require.NoError(t, err)
+
+	g, err := topic.Group("g")
+	require.NoError(t, err)
+
+	err = topic.Put([]byte("a"))
+	require.NoError(t, err)
+	for _, m := range []string{"b", "c", "d"} {
+		err = topic.PutTTL([]byte(m), 10*time.Millisecond)
+		require.NoError(t, err)
+	}
+	err = topic.Put([]byte("e"))
+	require.NoError(t, err)
+
+	b, err := topic.Get()
+	require.NoError(t, err)
+	require.Equal(t, []byte("a"), b)
+
+	b, err = topic.Peek()
+	require.NoError(t, err)
+	require.Equal(t, []byte("b"), b)
+
+	time.Sleep(20 * time.Millisecond)
+
+	// expired messages are skipped
+	b, err = topic.Peek()
+	require.NoError(t, err)
+	require.Equal(t, []byte("e"), b)
+	err = topic.Drop(b)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), topic.Pending())
+
+	bs, err := g.GetBatch(10)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("a"), []byte("e")}, bs)
+
+	// expired messages are acked without delivery
+	g2, err := topic.Group("g2")
+	require.NoError(t, err)
+	err = topic.PutTTL([]byte("f"), 10*time.Millisecond)
+	require.NoError(t, err)
+	m, err := g2.Receive(time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, []byte("f"), m.Data)
+	err = g2.Nack(m.Receipt)
+	require.NoError(t, err)
+
+	time.Sleep(20 * time.Millisecond)
+	_, err = g2.Receive(time.Minute)
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, int64(0), g2.Pending())
+
+	// an expired message with the same data is not matched by Drop
+	err = topic.PutTTL([]byte("x"), 10*time.Millisecond)
+	require.NoError(t, err)
+	err = topic.Put([]byte("x"))
+	require.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+	err = topic.Drop([]byte("y"))
+	require.Equal(t, ErrInvalidMsg, err)
+	err = topic.Drop([]byte("x"))
+	require.NoError(t, err)
+	require.Equal(t, int64(0), topic.Pending())
+}
+
+func TestRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fhck-mq")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mq, err := NewQueue(dir, nil)
+	require.NoError(t, err)
+
+	topic, err := mq.Get(0)
+	require.NoError(t, err)
+	require.Equal(t, Retention{}, topic.Retention())
+
+	g, err := topic.Group("g")
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		err = topic.Put([]byte(fmt.Sprint(i)))
+		require.NoError(t, err)
+	}
+	_, err = g.Get()
+	require.NoError(t, err)
+
+	// only the last 3 messages are retained by all groups
+	r := Retention{MaxBytes: 3 * frameSize(frameCRC|frameTime, 1)}
+	err = topic.SetRetention(r)
+	require.NoError(t, err)
+	require.Equal(t, r, topic.Retention())
+	require.Equal(t, int64(3), topic.Pending())
+	require.Equal(t, int64(3), g.Pending())
+
+	b, err := g.Get()
+	require.NoError(t, err)
+	require.Equal(t, []byte("7"), b)
+
+	err = topic.Put([]byte("10"))
+	require.NoError(t, err)
+	require.Equal(t, int64(2), topic.Pending())
+	require.Equal(t, int64(2), g.Pending())
+
+	r = Retention{MaxAge: 10 * time.Millisecond}
+	err = topic.SetRetention(r)
+	require.NoError(t, err)
+	mq.Close()
+
+	// retention is persisted
+	mq, err = NewQueue(dir, nil)
+	require.NoError(t, err)
+	defer mq.Close()
+
+	topic, err = mq.Get(0)
+	require.NoError(t, err)
+	require.Equal(t, r, topic.Retention())
+
+	time.Sleep(20 * time.Millisecond)
+	err = topic.Put([]byte("11"))
+	require.NoError(t, err)
+	require.Equal(t, int64(1), topic.Pending())
+
+	g, err = topic.Group("g")
+	require.NoError(t, err)
+	require.Equal(t, int64(1), g.Pending())
+
+	b, err = topic.Get()
+	require.NoError(t, err)
+	require.Equal(t, []byte("11"), b)
+}
+
+func TestRetentionReclaim(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fhck-mq")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mq, err := NewQueue(dir, nil)
+	require.NoError(t, err)
+	defer mq.Close()
+
+	topic, err := mq.Get(0)
+	require.NoError(t, err)
+
+	blkSize := int64(mq.vol.BlockSize)
+	err = topic.SetRetention(Retention{MaxBytes: blkSize})
+	require.NoError(t, err)
+
+	// storage of unconsumed messages is reclaimed
+	msg := make([]byte, 60<<10)
+	for i := 0; i < 40; i++ {
+		err = topic.Put(msg)
+		require.NoError(t, err)
+	}
+	require.True(t, topic.rec >= 3*blkSize)
+	require.True(t, topic.Pending() <= blkSize/int64(len(msg)))
+}
@@ -0,0 +1,100 @@
+package mq
+
+import (
+	"errors"
+)
+
+var (
+	// ErrInvalidPosition indicates the position is out of topic or its storage has been reclaimed.
+	ErrInvalidPosition = errors.New("invalid position")
+)
+
+// Position is the offset of a message in topic, it's stable and never moved.
+type Position int64
+
+// Scanner walks messages of a topic from a position without consuming them.
+// Messages are read one by one with the topic read lock, producers and consumers are not blocked.
+type Scanner struct {
+	t    *Topic
+	off  int64 // off of the next message
+	pos  Position
+	data []byte
+	err  error
+}
+
+// Scan returns a scanner from position from, 0 means from the oldest message of all groups.
+// Expired messages are returned too.
+func (t *Topic) Scan(from Position) *Scanner {
+	t.l.RLock()
+	defer t.l.RUnlock()
+
+	s := &Scanner{t: t, off: int64(from)}
+	if from == 0 {
+		s.off = t.slowest().off()
+	}
+	return s
+}
+
+// Next reads the next message, returns false if there's no more message or an error occurred.
+// It can be called again after new messages are put.
+func (s *Scanner) Next() bool {
+	if s.err != nil {
+		return false
+	}
+
+	t := s.t
+	t.l.RLock()
+	defer t.l.RUnlock()
+
+	if s.off < headerSize || s.off < t.rec || s.off > t.idx.PutOff {
+		s.err = ErrInvalidPosition
+		return false
+	}
+	if s.off == t.idx.PutOff {
+		return false
+	}
+
+	f, err := t.file()
+	if err != nil {
+		s.err = err
+		return false
+	}
+
+	fr, err := readFrame(f, s.off, t.idx.PutOff, s.off < t.idx.LegacyEnd)
+	if err != nil {
+		s.err = err
+		return false
+	}
+	s.pos, s.data = Position(s.off), fr.data
+	s.off += fr.n
+	return true
+}
+
+// Bytes returns the message read by the last Next.
+func (s *Scanner) Bytes() []byte {
+	return s.data
+}
+
+// Position returns the position of the message read by the last Next,
+// scan from it to read the message again.
+func (s *Scanner) Position() Position {
+	return s.pos
+}
+
+// Err returns the error stopped the scanner.
+func (s *Scanner) Err() error {
+	return s.err
+}
+
+// Position returns the position of the next message to get by this group.
+func (g *Group) Position() Position {
+	g.t.l.RLock()
+	defer g.t.l.RUnlock()
+
+	return Position(g.off())
+}
+
+// Position returns the position of the next message to get by the default group.
+func (t *Topic) Position() Position {
+	return t.def.Position()
+}
@@ -0,0 +1,111 @@
+package mq
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestScan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fhck-mq")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mq, err := NewQueue(dir, nil)
+	require.NoError(t, err)
+	defer mq.Close()
+
+	topic, err := mq.Get(0)
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		err = topic.Put([]byte(fmt.Sprint(i)))
+		require.NoError(t, err)
+	}
+	_, err = topic.Get()
+	require.NoError(t, err)
+
+	// starts from the oldest message, get offset is not moved
+	var ps []Position
+	s := topic.Scan(0)
+	for i := 1; s.Next(); i++ {
+		require.Equal(t, []byte(fmt.Sprint(i)), s.Bytes())
+		ps = append(ps, s.Position())
+	}
+	require.NoError(t, s.Err())
+	require.Equal(t, 4, len(ps))
+	require.Equal(t, ps[0], topic.Position())
+	require.Equal(t, int64(4), topic.Pending())
+
+	// continues after new messages are put
+	err = topic.Put([]byte("5"))
+	require.NoError(t, err)
+	require.True(t, s.Next())
+	require.Equal(t, []byte("5"), s.Bytes())
+	require.False(t, s.Next())
+
+	// replay from a position
+	s = topic.Scan(ps[2])
+	require.True(t, s.Next())
+	require.Equal(t, []byte("3"), s.Bytes())
+	require.Equal(t, ps[2], s.Position())
+
+	s = topic.Scan(ps[0] + 1)
+	require.False(t, s.Next())
+	require.Equal(t, ErrBrokenMsg, s.Err())
+
+	s = topic.Scan(1 << 40)
+	require.False(t, s.Next())
+	require.Equal(t, ErrInvalidPosition, s.Err())
+}
+
+func TestScanParallel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fhck-mq")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mq, err := NewQueue(dir, nil)
+	require.NoError(t, err)
+	defer mq.Close()
+
+	topic, err := mq.Get(0)
+	require.NoError(t, err)
+
+	const N = 1000
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < N; i++ {
+			err := topic.Put([]byte(fmt.Sprint(i)))
+			require.NoError(t, err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < N; {
+			_, err := topic.Get()
+			if err == nil {
+				i++
+			}
+		}
+	}()
+
+	// scanned messages are in order, scanner may fall behind the reclaimed storage
+	s := topic.Scan(0)
+	last := -1
+	for last < N-1 && s.Err() == nil {
+		for s.Next() {
+			var i int
+			fmt.Sscan(string(s.Bytes()), &i)
+			require.Equal(t, last+1, i)
+			last = i
+		}
+	}
+	require.True(t, s.Err() == nil || s.Err() == ErrInvalidPosition)
+	wg.Wait()
+}
@@ -0,0 +1,110 @@
+package mq
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/justmao945/tama/mfs"
+)
+
+const (
+	seqInterval  = 1024 // messages between two seq entries
+	seqEntrySize = 8
+)
+
+// putSeq saves off of message seq to the sparse seq index if it's on the interval.
+func (t *Topic) putSeq(f *mfs.File, seq, off int64) (err error) {
+	if seq%seqInterval != 0 {
+		return
+	}
+	var raw [seqEntrySize]byte
+	binary.LittleEndian.PutUint64(raw[:], uint64(off))
+	_, err = f.WriteAt(raw[:], seqOff+seq/seqInterval*seqEntrySize)
+	return
+}
+
+// getSeq returns off of message k * seqInterval, 0 if it's not saved.
+func (t *Topic) getSeq(f *mfs.File, k int64) (off int64, err error) {
+	var raw [seqEntrySize]byte
+	_, err = f.ReadAt(raw[:], seqOff+k*seqEntrySize)
+	if err == io.EOF {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	off = int64(binary.LittleEndian.Uint64(raw[:]))
+	return
+}
+
+// SeekSeq returns the position of message n, sequence of the first message put to the topic is 0.
+// Position of the next message to put is returned if n is Count.
+func (t *Topic) SeekSeq(n int64) (pos Position, err error) {
+	t.l.RLock()
+	defer t.l.RUnlock()
+
+	if n < 0 || n > t.idx.Count {
+		err = ErrInvalidPosition
+		return
+	}
+	if n == t.idx.Count {
+		pos = Position(t.idx.PutOff)
+		return
+	}
+
+	f, err := t.file()
+	if err != nil {
+		return
+	}
+
+	// start from the nearest group or seq entry before n
+	off, seq := int64(-1), int64(-1)
+	for _, g := range t.groups {
+		if g.next() <= n && g.next() > seq {
+			off, seq = g.off(), g.next()
+		}
+	}
+	if t.def.next() <= n && t.def.next() > seq {
+		off, seq = t.def.off(), t.def.next()
+	}
+	for k := n / seqInterval; k*seqInterval > seq; k-- {
+		var e int64
+		e, err = t.getSeq(f, k)
+		if err != nil {
+			return
+		}
+		if e >= headerSize && e >= t.rec && e < t.idx.PutOff { // not saved by legacy topic or reclaimed
+			off, seq = e, k*seqInterval
+			break
+		}
+	}
+	if seq < 0 {
+		err = ErrInvalidPosition
+		return
+	}
+
+	for ; seq < n; seq++ {
+		var fr *frame
+		fr, err = readFrameHeader(f, off, off < t.idx.LegacyEnd)
+		if err != nil {
+			return
+		}
+		off += fr.n
+	}
+	pos = Position(off)
+	return
+}
+
+// Seq returns the sequence of the next message to get by this group.
+func (g *Group) Seq() int64 {
+	g.t.l.RLock()
+	defer g.t.l.RUnlock()
+
+	return g.next()
+}
+
+// Seq returns the sequence of the next message to get by the default group.
+func (t *Topic) Seq() int64 {
+	return t.def.Seq()
+}
@@ -0,0 +1,74 @@
+package mq
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSeq(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fhck-mq")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mq, err := NewQueue(dir, nil)
+	require.NoError(t, err)
+
+	topic, err := mq.Get(0)
+	require.NoError(t, err)
+
+	const N = 3 * seqInterval
+	for i := 0; i < N; i++ {
+		err = topic.Put([]byte(fmt.Sprint(i)))
+		require.NoError(t, err)
+	}
+	for i := 0; i < 100; i++ {
+		_, err = topic.Get()
+		require.NoError(t, err)
+	}
+	require.Equal(t, int64(100), topic.Seq())
+
+	seek := func(n int64) []byte {
+		pos, err := topic.SeekSeq(n)
+		require.NoError(t, err)
+		s := topic.Scan(pos)
+		require.True(t, s.Next())
+		return s.Bytes()
+	}
+	for _, n := range []int64{0, 50, 100, seqInterval, 2*seqInterval + 10, N - 1} {
+		require.Equal(t, []byte(fmt.Sprint(n)), seek(n))
+	}
+
+	pos, err := topic.SeekSeq(N)
+	require.NoError(t, err)
+	require.Equal(t, Position(topic.idx.PutOff), pos)
+	_, err = topic.SeekSeq(N + 1)
+	require.Equal(t, ErrInvalidPosition, err)
+	mq.Close()
+
+	// seq index is persisted
+	mq, err = NewQueue(dir, nil)
+	require.NoError(t, err)
+	defer mq.Close()
+
+	topic, err = mq.Get(0)
+	require.NoError(t, err)
+	require.Equal(t, int64(100), topic.Seq())
+	require.Equal(t, []byte(fmt.Sprint(N-10)), seek(N-10))
+
+	// reclaimed messages can not be sought
+	msg := make([]byte, 60<<10)
+	err = topic.SetRetention(Retention{MaxBytes: 3 * frameSize(frameCRC|frameTime, len(msg))})
+	require.NoError(t, err)
+	for i := 0; i < 40; i++ {
+		err = topic.Put(msg)
+		require.NoError(t, err)
+	}
+	_, err = topic.SeekSeq(0)
+	require.Equal(t, ErrInvalidPosition, err)
+	require.Equal(t, int64(N+40-3), topic.Seq())
+	require.Equal(t, msg, seek(N+40-1))
+}
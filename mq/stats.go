@@ -0,0 +1,142 @@
+package mq
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Stats of a queue.
+type Stats struct {
+	Rounds int          // rounds allocated by the volume
+	Size   int64        // bytes of all rounds on disk
+	Used   int64        // bytes of blocks used by topics
+	Topics []TopicStats // sorted by id
+}
+
+// TopicStats of a topic, pending stats are of the default group.
+type TopicStats struct {
+	ID           uint32
+	Name         string
+	Count        int64 // all messages put to this topic
+	Pending      int64
+	PendingBytes int64
+	OldestAge    time.Duration
+	Groups       []GroupStats // named groups
+}
+
+// GroupStats of a consumer group.
+type GroupStats struct {
+	Name         string
+	Pending      int64         // messages can be get by this group
+	PendingBytes int64         // bytes of pending messages on disk
+	OldestAge    time.Duration // age of the oldest pending message, 0 if empty or unknown
+}
+
+// Stats returns stats of the queue and all its topics.
+func (q *Queue) Stats() (s Stats) {
+	vs := q.vol.Stat()
+	s.Rounds, s.Size, s.Used = vs.Rounds, vs.Size, vs.Used
+	for _, t := range q.Topics() {
+		s.Topics = append(s.Topics, t.Stats())
+	}
+	return
+}
+
+// Stats returns stats of this topic and its groups.
+func (t *Topic) Stats() (s TopicStats) {
+	t.l.RLock()
+	defer t.l.RUnlock()
+
+	now := time.Now().UnixNano()
+	def := t.def.stats(now)
+	s.ID, s.Name, s.Count = t.id, t.name, t.idx.Count
+	s.Pending, s.PendingBytes, s.OldestAge = def.Pending, def.PendingBytes, def.OldestAge
+
+	gs := make([]*Group, 0, len(t.groups))
+	for _, g := range t.groups {
+		gs = append(gs, g)
+	}
+	sort.Sort(byEntry(gs))
+	for _, g := range gs {
+		s.Groups = append(s.Groups, g.stats(now))
+	}
+	return
+}
+
+func (g *Group) stats(now int64) (s GroupStats) {
+	t := g.t
+	s.Name = g.name
+	s.Pending = t.idx.Count - g.next()
+	s.PendingBytes = t.idx.PutOff - g.off()
+	if s.Pending == 0 {
+		return
+	}
+
+	f, err := t.file()
+	if err != nil {
+		return
+	}
+	fr, err := readFrameHeader(f, g.off(), g.off() < t.idx.LegacyEnd)
+	if err == nil && fr.time != 0 {
+		s.OldestAge = time.Duration(now - fr.time)
+	}
+	return
+}
+
+// Var returns the stats as an expvar, publish it by expvar.Publish.
+func (q *Queue) Var() expvar.Var {
+	return expvar.Func(func() interface{} {
+		return q.Stats()
+	})
+}
+
+// PrometheusHandler returns a handler writing stats in Prometheus text format.
+func (q *Queue) PrometheusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		q.Stats().WritePrometheus(w)
+	})
+}
+
+// WritePrometheus writes stats in Prometheus text format.
+func (s Stats) WritePrometheus(w io.Writer) {
+	gauge := func(name, help string, v interface{}) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %v\n", name, help, name, name, v)
+	}
+	gauge("mq_rounds", "Rounds allocated by the volume.", s.Rounds)
+	gauge("mq_size_bytes", "Bytes of all rounds on disk.", s.Size)
+	gauge("mq_used_bytes", "Bytes of blocks used by topics.", s.Used)
+
+	fmt.Fprintf(w, "# HELP mq_topic_messages_total Messages put to the topic.\n# TYPE mq_topic_messages_total counter\n")
+	for _, t := range s.Topics {
+		fmt.Fprintf(w, "mq_topic_messages_total{topic=\"%d\",name=\"%s\"} %d\n", t.ID, escapeLabel(t.Name), t.Count)
+	}
+
+	groups := func(name, help string, v func(GroupStats) interface{}) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+		for _, t := range s.Topics {
+			def := GroupStats{Pending: t.Pending, PendingBytes: t.PendingBytes, OldestAge: t.OldestAge}
+			for _, g := range append([]GroupStats{def}, t.Groups...) {
+				fmt.Fprintf(w, "%s{topic=\"%d\",name=\"%s\",group=\"%s\"} %v\n",
+					name, t.ID, escapeLabel(t.Name), escapeLabel(g.Name), v(g))
+			}
+		}
+	}
+	groups("mq_group_pending", "Messages can be get by the group.",
+		func(g GroupStats) interface{} { return g.Pending })
+	groups("mq_group_pending_bytes", "Bytes of pending messages of the group.",
+		func(g GroupStats) interface{} { return g.PendingBytes })
+	groups("mq_group_oldest_age_seconds", "Age of the oldest pending message of the group.",
+		func(g GroupStats) interface{} { return g.OldestAge.Seconds() })
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
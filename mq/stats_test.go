@@ -0,0 +1,68 @@
+package mq
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fhck-mq")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mq, err := NewQueue(dir, nil)
+	require.NoError(t, err)
+	defer mq.Close()
+
+	topic, err := mq.GetByName("foo")
+	require.NoError(t, err)
+	g, err := topic.Group("g")
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		err = topic.Put([]byte(fmt.Sprint(i)))
+		require.NoError(t, err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	_, err = g.GetBatch(3)
+	require.NoError(t, err)
+	_, err = topic.Get()
+	require.NoError(t, err)
+
+	s := mq.Stats()
+	require.Equal(t, 1, s.Rounds)
+	require.True(t, s.Size > 0 && s.Used > 0)
+	require.Equal(t, 1, len(s.Topics))
+
+	ts := s.Topics[0]
+	require.Equal(t, topic.ID(), ts.ID)
+	require.Equal(t, "foo", ts.Name)
+	require.Equal(t, int64(3), ts.Count)
+	require.Equal(t, int64(2), ts.Pending)
+	require.Equal(t, 2*frameSize(frameCRC|frameTime, 1), ts.PendingBytes)
+	require.True(t, ts.OldestAge >= 10*time.Millisecond)
+	require.Equal(t, []GroupStats{{Name: "g"}}, ts.Groups)
+
+	// expvar
+	var s2 Stats
+	err = json.Unmarshal([]byte(mq.Var().String()), &s2)
+	require.NoError(t, err)
+	require.Equal(t, s.Topics[0].Count, s2.Topics[0].Count)
+
+	// prometheus
+	buf := bytes.NewBuffer(nil)
+	s.WritePrometheus(buf)
+	out := buf.String()
+	require.True(t, strings.Contains(out, "# TYPE mq_rounds gauge\nmq_rounds 1\n"))
+	require.True(t, strings.Contains(out, fmt.Sprintf(`mq_topic_messages_total{topic="%d",name="foo"} 3`, topic.ID())))
+	require.True(t, strings.Contains(out, fmt.Sprintf(`mq_group_pending{topic="%d",name="foo",group=""} 2`, topic.ID())))
+	require.True(t, strings.Contains(out, fmt.Sprintf(`mq_group_pending{topic="%d",name="foo",group="g"} 0`, topic.ID())))
+}
@@ -1,19 +1,22 @@
 package mq
 
 import (
-	"encoding/binary"
+	"context"
 	"errors"
-	"hash/crc32"
 	"io"
-	"math"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
-	"github.com/qiniu/bytes"
+	"github.com/justmao945/tama/mfs"
 )
 
 const (
-	headerSize = 48 // 4 + 4 + 5 * 8
-	flagClosed = 1
+	flagClosed  = 1 << iota
+	flagFramed  // messages after LegacyEnd are written with v1 framing
+	flagDeleted // topic is deleted, storage is being released
+	flagDefault // the default group has got messages
 )
 
 var (
@@ -22,46 +25,39 @@ var (
 
 	// ErrClosedTopic indicates put to closed topic
 	ErrClosedTopic = errors.New("closed topic")
-)
 
-// -------------------------------------------------------------------
+	// ErrTooLargeMsg indicates message length exceed MaxMsgSize.
+	ErrTooLargeMsg = errors.New("too large message")
 
-type index struct {
-	Flag     int32 // index flag
-	PutOff   int64
-	GetOff   int64
-	Count    int64 // all messages put to this Topic
-	Pending  int64 // pending messages can be get
-	Reserved int64
-}
+	// ErrBrokenMsg indicates the message is broken: crc32 mismatch or invalid frame
+	ErrBrokenMsg = errors.New("broken message")
 
-func (i *index) Bytes() []byte {
-	b := make([]byte, headerSize)
-	w := bytes.NewWriter(b[4:])
-	binary.Write(w, binary.LittleEndian, i)
-	binary.LittleEndian.PutUint32(b, crc32.ChecksumIEEE(b[4:]))
-	return b
-}
+	// ErrInvalidMsg indicates drop a message which is not the head of topic
+	ErrInvalidMsg = errors.New("invalid message")
 
-func parseIndex(b []byte) (idx *index, err error) {
-	if binary.LittleEndian.Uint32(b) != crc32.ChecksumIEEE(b[4:]) {
-		err = ErrBrokenIndex
-		return
-	}
-	idx = &index{}
-	r := bytes.NewReader(b[4:])
-	binary.Read(r, binary.LittleEndian, idx)
-	return
-}
+	// ErrDeletedTopic indicates the topic has been deleted from queue.
+	ErrDeletedTopic = errors.New("deleted topic")
+)
 
 // -------------------------------------------------------------------
 
 // Topic is a FIFO queue to put and get messages.
 type Topic struct {
-	q   *Queue
-	id  uint32
-	idx *index
-	l   sync.RWMutex
+	q      *Queue
+	id     uint32
+	name   string // registered name, may be empty
+	idx    *index
+	ret    *retentionIndex
+	dedup  *dedup
+	dead   *deadIndex
+	rec    int64 // blocks below this off have been released
+	def    *Group
+	groups map[string]*Group
+	ngroup int64         // entries used in group region, including deleted ones
+	puts   int           // puts after last sync
+	synced *index        // index at the last sync of puts
+	ready  chan struct{} // closed and renewed on put, close and delete
+	l      sync.RWMutex
 }
 
 func newTopic(q *Queue, id uint32) (t *Topic, err error) {
@@ -70,208 +66,519 @@ func newTopic(q *Queue, id uint32) (t *Topic, err error) {
 		return
 	}
 
-	idx := &index{PutOff: headerSize, GetOff: headerSize}
-	raw := make([]byte, headerSize)
-	_, err = f.ReadAt(raw, 0)
-	if err == io.EOF { // new index
-		err = nil
-	} else if err != nil {
+	idx, err := loadIndex(f)
+	if err != nil {
 		return
-	} else {
-		idx, err = parseIndex(raw)
-		if err != nil {
-			return
+	}
+	if idx == nil {
+		idx = &index{PutOff: headerSize, GetOff: headerSize, Flag: flagFramed}
+	}
+	if idx.Flag&flagFramed == 0 { // upgrade, new messages will be put after the legacy ones
+		idx.Flag |= flagFramed
+		idx.LegacyEnd = idx.PutOff
+	}
+
+	t = &Topic{
+		q:      q,
+		id:     id,
+		name:   q.reg.ids[id],
+		idx:    idx,
+		ret:    &retentionIndex{},
+		dedup:  newDedup(dedupOff),
+		dead:   &deadIndex{},
+		synced: idx,
+		ready:  make(chan struct{}),
+		groups: make(map[string]*Group),
+	}
+	t.def = &Group{t: t, i: -1}
+	if idx.Flag&flagDeleted != 0 { // will be deleted by queue
+		return
+	}
+
+	t.ret, err = loadRetention(f)
+	if err != nil {
+		return
+	}
+
+	t.dead, err = loadDead(f)
+	if err != nil {
+		return
+	}
+
+	gis, err := loadGroups(f)
+	if err != nil {
+		return
+	}
+	for i, gi := range gis {
+		if gi.Flag&groupDeleted != 0 {
+			continue
 		}
+		g := &Group{t: t, name: string(gi.Name[:]), i: int64(i), gi: gi}
+		g.name = strings.TrimRight(g.name, "\x00")
+		t.groups[g.name] = g
 	}
+	t.ngroup = int64(len(gis))
 
-	_, err = f.WriteAt(idx.Bytes(), 0)
+	err = t.verify(f, q.Recover)
 	if err != nil {
 		return
 	}
 
-	t = &Topic{
-		q:   q,
-		id:  id,
-		idx: idx,
+	t.dedup, err = loadDedup(f, t.idx.DedupOff, t.idx.DedupEnd)
+	if err != nil {
+		return
+	}
+
+	newIdx := *t.idx
+	err = t.commit(f, &newIdx)
+	if err != nil {
+		return
+	}
+
+	err = t.retain(f)
+	if err != nil {
+		return
 	}
+
+	t.reclaim(f) // release consumed blocks left by last run
 	return
 }
 
-// ID returns unique topic id
-func (t *Topic) ID() uint32 {
-	return t.id
-}
+// verify checks all messages after the slowest group, truncate the topic to the last good one if fix is true.
+// Groups after the truncated off are moved back to it.
+func (t *Topic) verify(f *mfs.File, fix bool) (err error) {
+	slowest := t.slowest()
+	off, next := slowest.off(), slowest.next()
+	for off < t.idx.PutOff {
+		var fr *frame
+		fr, err = readFrame(f, off, t.idx.PutOff, off < t.idx.LegacyEnd)
+		if err != nil {
+			break
+		}
+		off += fr.n
+		next++
+	}
+	if err == nil && next == t.idx.Count {
+		return
+	}
+	if !fix {
+		if err == nil {
+			err = ErrBrokenMsg
+		}
+		return
+	}
 
-// Count returns all message had been put to this topic
-func (t *Topic) Count() int64 {
-	t.l.RLock()
-	defer t.l.RUnlock()
+	err = nil
+	for _, g := range t.groups {
+		if g.off() > off {
+			err = g.commit(f, off, next)
+			if err != nil {
+				return
+			}
+		}
+	}
 
-	return t.idx.Count
+	newIdx := *t.idx
+	defNext := t.def.next()
+	if newIdx.GetOff > off {
+		newIdx.GetOff, defNext = off, next
+	}
+	newIdx.PutOff = off
+	newIdx.Count = next
+	newIdx.Pending = next - defNext
+	t.idx = &newIdx
+	return
 }
 
-// Pending returns messages can be get.
-func (t *Topic) Pending() int64 {
-	t.l.RLock()
-	defer t.l.RUnlock()
+// follows returns the slowest named group if FollowGroups is set and the default group is never used.
+// The default group follows it, so storage is not retained for a default group nobody reads.
+func (t *Topic) follows() (s *Group) {
+	if !t.q.FollowGroups || t.idx.Flag&flagDefault != 0 || t.idx.GetOff != headerSize {
+		return
+	}
+	for _, g := range t.groups {
+		if s == nil || g.gi.GetOff < s.gi.GetOff {
+			s = g
+		}
+	}
+	return
+}
 
-	return t.idx.Pending
+// slowest returns the group with the smallest off, storage before it can be reclaimed.
+func (t *Topic) slowest() (s *Group) {
+	s = t.def
+	for _, g := range t.groups {
+		if g.off() < s.off() {
+			s = g
+		}
+	}
+	return
 }
 
-// Close marks this topic as closed. Message can not be put to this topic after closed,
-// but is still able to read pending messages.
-func (t *Topic) Close() (err error) {
+// Group returns a consumer group of this topic, will create a new one if is not exist.
+// A new group starts from the slowest group.
+func (t *Topic) Group(name string) (g *Group, err error) {
+	if name == "" || len(name) > maxGroupName {
+		err = ErrInvalidGroup
+		return
+	}
+
 	t.l.Lock()
 	defer t.l.Unlock()
 
-	if t.idx.Flag&flagClosed != 0 {
+	g, ok := t.groups[name]
+	if ok {
 		return
 	}
 
-	newIdx := *t.idx
-	newIdx.Flag |= flagClosed
-
-	f, err := t.q.vol.Open(t.id)
+	f, err := t.file()
 	if err != nil {
 		return
 	}
 
-	_, err = f.WriteAt(newIdx.Bytes(), 0)
+	slowest := t.slowest()
+	gi := &groupIndex{}
+	copy(gi.Name[:], name)
+
+	g0 := &Group{t: t, name: name, i: t.ngroup, gi: gi}
+	err = g0.commit(f, slowest.off(), slowest.next())
 	if err != nil {
 		return
 	}
 
-	t.idx.Flag = newIdx.Flag
+	t.ngroup++
+	t.groups[name] = g0
+	g = g0
 	return
 }
 
-func (t *Topic) peek() (b []byte, err error) {
-	f, err := t.q.vol.Open(t.id)
-	if err != nil {
-		return
+// FindGroup returns a consumer group, ok is false if it's not exist. Unlike Group, it never creates one.
+func (t *Topic) FindGroup(name string) (g *Group, ok bool) {
+	t.l.RLock()
+	defer t.l.RUnlock()
+
+	g, ok = t.groups[name]
+	return
+}
+
+// Groups returns all consumer groups of this topic, excluding the default one.
+func (t *Topic) Groups() (res []*Group) {
+	t.l.RLock()
+	defer t.l.RUnlock()
+
+	for _, g := range t.groups {
+		res = append(res, g)
 	}
+	sort.Sort(byEntry(res))
+	return
+}
 
-	if t.idx.GetOff >= t.idx.PutOff {
-		if t.idx.Flag&flagClosed != 0 {
-			err = ErrClosedTopic
-		} else {
-			err = io.EOF
-		}
+// DeleteGroup removes a consumer group, storage will not be retained for it anymore.
+func (t *Topic) DeleteGroup(name string) (err error) {
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	g, ok := t.groups[name]
+	if !ok {
+		err = ErrInvalidGroup
 		return
 	}
 
-	raw := make([]byte, 2)
-	_, err = f.ReadAt(raw, t.idx.GetOff)
+	f, err := t.file()
 	if err != nil {
 		return
 	}
-	len := binary.LittleEndian.Uint16(raw)
 
-	raw = make([]byte, len)
-	_, err = f.ReadAt(raw, t.idx.GetOff+2)
+	g.gi.Flag |= groupDeleted
+	err = g.commit(f, g.off(), g.next())
 	if err != nil {
+		g.gi.Flag &^= groupDeleted
 		return
 	}
 
-	b = raw
+	delete(t.groups, name)
+	t.reclaim(f)
 	return
 }
 
-// Peek only returns the message, won't drop it.
-func (t *Topic) Peek() (b []byte, err error) {
+// file returns the file of this topic if it's not deleted.
+func (t *Topic) file() (f *mfs.File, err error) {
+	if t.idx.Flag&flagDeleted != 0 {
+		err = ErrDeletedTopic
+		return
+	}
+	return t.q.vol.Open(t.id)
+}
+
+// eof returns the error of reading after the last message.
+func (t *Topic) eof() error {
+	if t.idx.Flag&flagClosed != 0 {
+		return ErrClosedTopic
+	}
+	return io.EOF
+}
+
+// wake wakes up all waiters of this topic.
+func (t *Topic) wake() {
+	close(t.ready)
+	t.ready = make(chan struct{})
+}
+
+// ID returns unique topic id
+func (t *Topic) ID() uint32 {
+	return t.id
+}
+
+// Name returns the registered name of this topic, empty if it's got by id.
+func (t *Topic) Name() string {
+	return t.name
+}
+
+// Count returns all message had been put to this topic
+func (t *Topic) Count() int64 {
 	t.l.RLock()
 	defer t.l.RUnlock()
 
-	return t.peek()
+	return t.idx.Count
 }
 
-func (t *Topic) drop(len int) (err error) {
-	if t.idx.GetOff >= t.idx.PutOff {
-		if t.idx.Flag&flagClosed != 0 {
-			err = ErrClosedTopic
-		} else {
-			err = io.EOF
-		}
+// Pending returns messages can be get by the default group.
+func (t *Topic) Pending() int64 {
+	t.l.RLock()
+	defer t.l.RUnlock()
+
+	return t.idx.Count - t.def.next()
+}
+
+// Close marks this topic as closed. Message can not be put to this topic after closed,
+// but is still able to read pending messages.
+func (t *Topic) Close() (err error) {
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	if t.idx.Flag&flagClosed != 0 {
 		return
 	}
 
 	newIdx := *t.idx
-	newIdx.GetOff += 2 + int64(len)
-	newIdx.Pending--
+	newIdx.Flag |= flagClosed
 
-	f, err := t.q.vol.Open(t.id)
+	f, err := t.file()
 	if err != nil {
 		return
 	}
-	_, err = f.WriteAt(newIdx.Bytes(), 0)
+
+	err = t.commit(f, &newIdx)
 	if err != nil {
 		return
 	}
 
-	t.idx = &newIdx
+	t.wake()
 	return
 }
 
-// Drop should only be called after Peek and with the right message
-// FIXME: dangous if drop wrong message...
-func (t *Topic) Drop(b []byte) error {
-	t.l.Lock()
-	defer t.l.Unlock()
+// Peek only returns the message, won't drop it.
+func (t *Topic) Peek() (b []byte, err error) {
+	return t.def.Peek()
+}
+
+// reclaim releases the whole blocks below the slowest group.
+// Offsets are not changed, released blocks become file holes.
+// Index and group slots are flushed first, released blocks may be reused by other files at once,
+// so offsets restored after a crash must not point into them.
+func (t *Topic) reclaim(f *mfs.File) {
+	blkSize := int64(t.q.vol.BlockSize)
+	off := t.slowest().off()
+	if off/blkSize <= t.rec/blkSize { // no new whole block
+		return
+	}
+	if f.SyncRange(metaOff, groupOff-metaOff+t.ngroup*2*slotSize) != nil {
+		return // released next time
+	}
+	f.Discard(t.rec, off-t.rec)
+	t.rec = off / blkSize * blkSize
+}
 
-	return t.drop(len(b))
+// Drop should only be called after Peek and with the right message,
+// use Receive and Ack if there are many consumers.
+func (t *Topic) Drop(b []byte) error {
+	return t.def.Drop(b)
 }
 
 // Get returns a message in topic and drop it.
 func (t *Topic) Get() (b []byte, err error) {
-	t.l.Lock()
-	defer t.l.Unlock()
+	return t.def.Get()
+}
 
-	b, err = t.peek()
-	if err != nil {
-		return
-	}
+// PeekContext returns the message like Peek, but waits until a message is put, the topic is closed
+// or ctx is done.
+func (t *Topic) PeekContext(ctx context.Context) ([]byte, error) {
+	return t.def.PeekContext(ctx)
+}
 
-	err = t.drop(len(b))
-	return
+// GetContext returns a message and drop it like Get, but waits until a message is put, the topic
+// is closed or ctx is done.
+func (t *Topic) GetContext(ctx context.Context) ([]byte, error) {
+	return t.def.GetContext(ctx)
+}
+
+// GetBatch returns at most max messages in topic and drop them.
+func (t *Topic) GetBatch(max int) (bs [][]byte, err error) {
+	return t.def.GetBatch(max)
 }
 
 // Put a message to this topic.
-func (t *Topic) Put(b []byte) (err error) {
-	if len(b) > math.MaxUint16 {
-		panic("too large message to put to mq")
-	}
+func (t *Topic) Put(b []byte) error {
+	return t.PutBatch([][]byte{b})
+}
+
+// PutTTL puts a message which expires after ttl, expired messages are skipped by all groups.
+func (t *Topic) PutTTL(b []byte, ttl time.Duration) error {
+	return t.put([][]byte{b}, ttl, nil)
+}
+
+// PutBatch puts messages to this topic with one write and one index commit,
+// either all messages are put or none of them.
+func (t *Topic) PutBatch(bs [][]byte) error {
+	return t.put(bs, 0, nil)
+}
 
+// put puts messages, key is saved with the first message for dedup if it's not nil.
+func (t *Topic) put(bs [][]byte, ttl time.Duration, key []byte) (err error) {
 	t.l.Lock()
 	defer t.l.Unlock()
 
+	return t.write(bs, ttl, key)
+}
+
+// write puts messages with lock held.
+func (t *Topic) write(bs [][]byte, ttl time.Duration, key []byte) (err error) {
+	flags := uint32(frameCRC | frameTime)
+	if ttl > 0 {
+		flags |= frameTTL
+	}
+	size := int64(0)
+	for _, b := range bs {
+		if len(b) > MaxMsgSize {
+			err = ErrTooLargeMsg
+			return
+		}
+		size += frameSize(flags, len(b))
+	}
+
 	if t.idx.Flag&flagClosed != 0 {
 		err = ErrClosedTopic
 		return
 	}
 
-	f, err := t.q.vol.Open(t.id)
+	f, err := t.file()
 	if err != nil {
 		return
 	}
 
-	raw := make([]byte, 2+len(b))
-	binary.LittleEndian.PutUint16(raw, uint16(len(b)))
-	copy(raw[2:], b)
+	now, deadline := time.Now().UnixNano(), int64(0)
+	if ttl > 0 {
+		deadline = now + int64(ttl)
+	}
+
+	var rec []byte
+	dedupStart := t.idx.DedupOff
+	if key != nil {
+		dedupStart, err = t.dedup.check(f, key, now, t.q.DedupWindow)
+		if err != nil {
+			return
+		}
+		rec = appendDedupKey(nil, key, now, t.idx.Count)
+		_, err = f.WriteAt(rec, t.dedup.end)
+		if err != nil {
+			return
+		}
+	}
 
+	raw := make([]byte, 0, size)
+	for i, b := range bs {
+		err = t.putSeq(f, t.idx.Count+int64(i), t.idx.PutOff+int64(len(raw)))
+		if err != nil {
+			return
+		}
+		raw = appendFrame(raw, b, now, deadline)
+	}
 	_, err = f.WriteAt(raw, t.idx.PutOff)
 	if err != nil {
 		return
 	}
 
 	newIdx := *t.idx
-	newIdx.PutOff += 2 + int64(len(b))
-	newIdx.Count++
-	newIdx.Pending++
-	_, err = f.WriteAt(newIdx.Bytes(), 0)
+	newIdx.PutOff += int64(len(raw))
+	newIdx.Count += int64(len(bs))
+	newIdx.Pending += int64(len(bs))
+	newIdx.DedupOff = dedupStart
+	if key != nil {
+		newIdx.DedupEnd = t.dedup.end + int64(len(rec))
+	}
+	err = t.commit(f, &newIdx)
 	if err != nil {
 		return
 	}
 
-	t.idx = &newIdx
+	if key != nil {
+		t.dedup.add(key, now, t.dedup.end+int64(len(rec)))
+		t.dedup.reclaim(f, dedupStart, int64(t.q.vol.BlockSize))
+	}
+
+	t.wake()
+
+	err = t.retain(f)
+	if err != nil {
+		return
+	}
+
+	t.puts += len(bs)
+	if t.q.SyncPuts > 0 && t.puts >= t.q.SyncPuts {
+		t.puts = 0
+		err = t.syncPuts(f)
+	}
 	return
 }
+
+// syncPuts flushes messages, dedup keys and seq entries put after the last sync,
+// and the index slot to disk.
+func (t *Topic) syncPuts(f *mfs.File) (err error) {
+	s, idx := t.synced, t.idx
+	dedupStart := s.DedupEnd
+	if dedupStart < idx.DedupOff {
+		dedupStart = idx.DedupOff
+	}
+	seqStart := (s.Count + seqInterval - 1) / seqInterval * seqEntrySize
+	seqEnd := (idx.Count + seqInterval - 1) / seqInterval * seqEntrySize
+
+	ranges := [][2]int64{
+		{s.PutOff, idx.PutOff - s.PutOff},
+		{dedupStart, idx.DedupEnd - dedupStart},
+		{seqOff + seqStart, seqEnd - seqStart},
+		{metaOff + idx.Seq%2*slotSize, slotSize},
+	}
+	for _, r := range ranges {
+		if r[1] <= 0 {
+			continue
+		}
+		err = f.SyncRange(r[0], r[1])
+		if err != nil {
+			return
+		}
+	}
+	t.synced = idx
+	return
+}
+
+// Sync flushes messages and index of this topic to disk.
+func (t *Topic) Sync() (err error) {
+	t.l.RLock()
+	defer t.l.RUnlock()
+
+	f, err := t.file()
+	if err != nil {
+		return
+	}
+	return f.Sync()
+}
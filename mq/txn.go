@@ -0,0 +1,408 @@
+package mq
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/justmao945/tama/mfs"
+)
+
+// Redo log of transactions in txn file, only the last record is kept:
+//
+//	| done slot 0 | done slot 1 | ... | record: | crc 4B | len 4B | seq 8B | op | op | ... |
+//
+//	put op: | 1 1B | topic 4B | put off 8B | n 4B | len 4B | data | ... |
+//	get op: | 2 1B | topic 4B | get off 8B | new off 8B | new next 8B | len 1B | group |
+//
+// A record is applied after it's written, then its seq is committed to done slots. Records not done
+// are applied again on open, ops already applied are skipped by checking offsets, torn records are
+// discarded.
+const (
+	txnFd         = registryFd - 1
+	txnRecordOff  = 4 << 10
+	txnHeaderSize = 4 + 4 + 8
+)
+
+// txn op types
+const (
+	opPut = 1 + iota
+	opGet
+)
+
+var (
+	// ErrTxnConflict indicates messages got by a transaction have been got by others before commit.
+	ErrTxnConflict = errors.New("transaction conflict")
+
+	// ErrTxnDone indicates the transaction has been committed or aborted.
+	ErrTxnDone = errors.New("transaction done")
+)
+
+// txnIndex saved in done slots, Seq is the last done record.
+type txnIndex struct {
+	Seq int64
+}
+
+func (i *txnIndex) seq() int64 { return i.Seq }
+
+type txnOp struct {
+	typ  byte
+	t    *Topic
+	g    *Group   // get only
+	l    *lease   // get only, the lease dropped by this get
+	bs   [][]byte // put only
+	off  int64    // put off or get off before applied
+	noff int64    // get off after applied
+	next int64    // get next after applied
+}
+
+// Txn groups puts and gets across topics of a queue, and commits them atomically.
+// Gets only see messages committed before, puts are invisible until committed.
+// Txn is not safe for concurrent use.
+type Txn struct {
+	q    *Queue
+	puts map[*Topic]*txnOp
+	gets []*txnOp
+	last map[*Group]*txnOp // last get of each group
+	done bool
+}
+
+// Txn starts a transaction.
+func (q *Queue) Txn() *Txn {
+	return &Txn{q: q, puts: make(map[*Topic]*txnOp), last: make(map[*Group]*txnOp)}
+}
+
+// Put puts a message to t on commit.
+func (tx *Txn) Put(t *Topic, b []byte) (err error) {
+	if tx.done {
+		err = ErrTxnDone
+		return
+	}
+	if len(b) > MaxMsgSize {
+		err = ErrTooLargeMsg
+		return
+	}
+
+	op, ok := tx.puts[t]
+	if !ok {
+		op = &txnOp{typ: opPut, t: t}
+		tx.puts[t] = op
+	}
+	op.bs = append(op.bs, b)
+	return
+}
+
+// Get returns a message of the default group of t, it's dropped on commit.
+func (tx *Txn) Get(t *Topic) ([]byte, error) {
+	return tx.GetGroup(t.def)
+}
+
+// GetGroup returns a message of g after messages got by this transaction, it's dropped on commit.
+// ErrTxnConflict is returned if the message is leased by Group.Receive, so is Commit if it's leased
+// after got.
+func (tx *Txn) GetGroup(g *Group) (b []byte, err error) {
+	if tx.done {
+		err = ErrTxnDone
+		return
+	}
+
+	t := g.t
+	t.l.RLock()
+	defer t.l.RUnlock()
+
+	f, err := t.file()
+	if err != nil {
+		return
+	}
+
+	off, next := g.off(), g.next()
+	if last, ok := tx.last[g]; ok {
+		off, next = last.noff, last.next
+	}
+
+	fr, hoff, skipped, err := g.head(f, off, time.Now().UnixNano())
+	if err != nil {
+		return
+	}
+
+	op := &txnOp{typ: opGet, t: t, g: g, off: off, noff: hoff + fr.n, next: next + skipped + 1}
+	if g.leased(op.off, op.noff, nil) {
+		err = ErrTxnConflict
+		return
+	}
+	tx.gets = append(tx.gets, op)
+	tx.last[g] = op
+	b = fr.data
+	return
+}
+
+// Abort discards this transaction.
+func (tx *Txn) Abort() {
+	tx.done = true
+}
+
+// Commit applies all puts and gets atomically, ErrTxnConflict is returned if messages got by
+// this transaction have been got by others, nothing is applied in that case.
+func (tx *Txn) Commit() (err error) {
+	if tx.done {
+		err = ErrTxnDone
+		return
+	}
+	tx.done = true
+
+	ops := append([]*txnOp(nil), tx.gets...)
+	for _, op := range tx.puts {
+		ops = append(ops, op)
+	}
+	if len(ops) == 0 {
+		return
+	}
+
+	q := tx.q
+	q.txnL.Lock()
+	defer q.txnL.Unlock()
+
+	unlock := lockTopics(ops)
+	defer unlock()
+
+	// check gets in order, and puts from the current off
+	offs := make(map[*Group]int64)
+	for _, op := range ops {
+		if _, err = op.t.file(); err != nil {
+			return
+		}
+		switch op.typ {
+		case opGet:
+			off, ok := offs[op.g]
+			if !ok {
+				off = op.g.off()
+			}
+			if off != op.off || op.t.groups[op.g.name] != op.g && op.g != op.t.def ||
+				op.g.leased(op.off, op.noff, op.l) {
+				err = ErrTxnConflict
+				return
+			}
+			offs[op.g] = op.noff
+		case opPut:
+			if op.t.idx.Flag&flagClosed != 0 {
+				err = ErrClosedTopic
+				return
+			}
+			op.off = op.t.idx.PutOff
+		}
+	}
+
+	f, err := q.vol.Open(txnFd)
+	if err != nil {
+		return
+	}
+	seq := q.txn.Seq + 1
+	rec := encodeTxn(seq, ops)
+	_, err = f.WriteAt(rec, txnRecordOff)
+	if err != nil {
+		return
+	}
+	if q.SyncPuts > 0 {
+		err = f.SyncRange(txnRecordOff, int64(len(rec)))
+		if err != nil {
+			return
+		}
+	}
+
+	err = applyTxn(ops)
+	if err != nil {
+		return
+	}
+	return q.doneTxn(f, seq)
+}
+
+// lockTopics locks topics of ops in id order, returns the unlock func.
+func lockTopics(ops []*txnOp) func() {
+	m := make(map[*Topic]bool)
+	var ts []*Topic
+	for _, op := range ops {
+		if !m[op.t] {
+			m[op.t] = true
+			ts = append(ts, op.t)
+		}
+	}
+	sort.Sort(byID(ts))
+	for _, t := range ts {
+		t.l.Lock()
+	}
+	return func() {
+		for _, t := range ts {
+			t.l.Unlock()
+		}
+	}
+}
+
+// applyTxn applies ops with topic locks held, ops already applied are skipped.
+func applyTxn(ops []*txnOp) (err error) {
+	for _, op := range ops {
+		t := op.t
+		var f *mfs.File
+		f, err = t.file()
+		if err != nil {
+			return
+		}
+		switch op.typ {
+		case opGet:
+			if op.g.off() != op.off {
+				continue
+			}
+			err = op.g.commit(f, op.noff, op.next)
+			if err != nil {
+				return
+			}
+			t.reclaim(f)
+		case opPut:
+			if t.idx.PutOff != op.off {
+				continue
+			}
+			err = t.write(op.bs, 0, nil)
+			if err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// doneTxn commits seq as the last done record.
+func (q *Queue) doneTxn(f *mfs.File, seq int64) (err error) {
+	ti := &txnIndex{Seq: seq}
+	_, err = f.WriteAt(encodeSlot(ti), seq%2*slotSize)
+	if err != nil {
+		return
+	}
+	q.txn = ti
+	return
+}
+
+func encodeTxn(seq int64, ops []*txnOp) []byte {
+	b := make([]byte, txnHeaderSize)
+	binary.LittleEndian.PutUint64(b[8:], uint64(seq))
+
+	var tmp [8]byte
+	for _, op := range ops {
+		b = append(b, op.typ)
+		binary.LittleEndian.PutUint32(tmp[:], op.t.id)
+		b = append(b, tmp[:4]...)
+		binary.LittleEndian.PutUint64(tmp[:], uint64(op.off))
+		b = append(b, tmp[:]...)
+		switch op.typ {
+		case opPut:
+			binary.LittleEndian.PutUint32(tmp[:], uint32(len(op.bs)))
+			b = append(b, tmp[:4]...)
+			for _, m := range op.bs {
+				binary.LittleEndian.PutUint32(tmp[:], uint32(len(m)))
+				b = append(b, tmp[:4]...)
+				b = append(b, m...)
+			}
+		case opGet:
+			binary.LittleEndian.PutUint64(tmp[:], uint64(op.noff))
+			b = append(b, tmp[:]...)
+			binary.LittleEndian.PutUint64(tmp[:], uint64(op.next))
+			b = append(b, tmp[:]...)
+			b = append(b, byte(len(op.g.name)))
+			b = append(b, op.g.name...)
+		}
+	}
+
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(b)-txnHeaderSize))
+	binary.LittleEndian.PutUint32(b, crc32.ChecksumIEEE(b[4:]))
+	return b
+}
+
+// txnReader decodes ops, errors are reported once at the end.
+type txnReader struct {
+	b   []byte
+	err error
+}
+
+func (r *txnReader) next(n int) (b []byte) {
+	if r.err != nil || len(r.b) < n {
+		r.err = ErrBrokenIndex
+		return make([]byte, n)
+	}
+	b, r.b = r.b[:n], r.b[n:]
+	return
+}
+
+func (r *txnReader) u32() uint32 { return binary.LittleEndian.Uint32(r.next(4)) }
+func (r *txnReader) i64() int64  { return int64(binary.LittleEndian.Uint64(r.next(8))) }
+
+// recoverTxn applies the last record if it's not done, ops of deleted topics or groups are skipped.
+func (q *Queue) recoverTxn(f *mfs.File) (err error) {
+	s, err := loadSlot(f, 0, func() slot { return &txnIndex{} })
+	if err != nil {
+		return
+	}
+	if s != nil {
+		q.txn = s.(*txnIndex)
+	}
+
+	hdr := make([]byte, txnHeaderSize)
+	_, err = f.ReadAt(hdr, txnRecordOff)
+	if err == io.EOF { // no record
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	seq := int64(binary.LittleEndian.Uint64(hdr[8:]))
+	if seq <= q.txn.Seq {
+		return
+	}
+	raw := make([]byte, txnHeaderSize+int64(binary.LittleEndian.Uint32(hdr[4:])))
+	_, err = f.ReadAt(raw, txnRecordOff)
+	if err != nil || binary.LittleEndian.Uint32(raw) != crc32.ChecksumIEEE(raw[4:]) { // torn
+		err = nil
+		return
+	}
+
+	var ops []*txnOp
+	r := &txnReader{b: raw[txnHeaderSize:]}
+	for len(r.b) > 0 && r.err == nil {
+		op := &txnOp{typ: r.next(1)[0]}
+		t, ok := q.Find(r.u32())
+		op.t, op.off = t, r.i64()
+		switch op.typ {
+		case opPut:
+			for n := r.u32(); n > 0 && r.err == nil; n-- {
+				op.bs = append(op.bs, r.next(int(r.u32())))
+			}
+		case opGet:
+			op.noff, op.next = r.i64(), r.i64()
+			name := string(r.next(int(r.next(1)[0])))
+			if ok {
+				op.g = t.def
+				if name != "" {
+					op.g, ok = t.FindGroup(name)
+				}
+			}
+		default:
+			r.err = ErrBrokenIndex
+		}
+		if ok {
+			ops = append(ops, op)
+		}
+	}
+	if r.err != nil {
+		err = r.err
+		return
+	}
+
+	unlock := lockTopics(ops)
+	err = applyTxn(ops)
+	unlock()
+	if err != nil {
+		return
+	}
+	return q.doneTxn(f, seq)
+}
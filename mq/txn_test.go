@@ -0,0 +1,215 @@
+package mq
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTxn(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fhck-mq")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mq, err := NewQueue(dir, nil)
+	require.NoError(t, err)
+	defer mq.Close()
+
+	a, err := mq.Get(0)
+	require.NoError(t, err)
+	b, err := mq.Get(1)
+	require.NoError(t, err)
+	g, err := a.Group("g")
+	require.NoError(t, err)
+
+	for _, m := range []string{"1", "2", "3"} {
+		err = a.Put([]byte(m))
+		require.NoError(t, err)
+	}
+
+	// move messages from a to b
+	tx := mq.Txn()
+	for _, m := range []string{"1", "2"} {
+		v, err := tx.Get(a)
+		require.NoError(t, err)
+		require.Equal(t, []byte(m), v)
+		err = tx.Put(b, v)
+		require.NoError(t, err)
+	}
+	v, err := tx.GetGroup(g)
+	require.NoError(t, err)
+	require.Equal(t, []byte("1"), v)
+	require.Equal(t, int64(3), a.Pending())
+	require.Equal(t, int64(0), b.Count())
+
+	err = tx.Commit()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), a.Pending())
+	require.Equal(t, int64(2), g.Pending())
+	bs, err := b.GetBatch(10)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("1"), []byte("2")}, bs)
+
+	err = tx.Commit()
+	require.Equal(t, ErrTxnDone, err)
+
+	// got by others before commit
+	tx = mq.Txn()
+	_, err = tx.Get(a)
+	require.NoError(t, err)
+	err = tx.Put(b, []byte("x"))
+	require.NoError(t, err)
+	_, err = a.Get()
+	require.NoError(t, err)
+	err = tx.Commit()
+	require.Equal(t, ErrTxnConflict, err)
+	require.Equal(t, int64(2), b.Count())
+
+	_, err = tx.Get(a)
+	require.Equal(t, ErrTxnDone, err)
+
+	tx = mq.Txn()
+	_, err = tx.Get(a)
+	require.Equal(t, io.EOF, err)
+	err = tx.Put(b, []byte("x"))
+	require.NoError(t, err)
+	tx.Abort()
+	require.Equal(t, int64(2), b.Count())
+
+	// leased by Receive
+	m, err := g.Receive(time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, []byte("2"), m.Data)
+	tx = mq.Txn()
+	_, err = tx.GetGroup(g)
+	require.Equal(t, ErrTxnConflict, err)
+	err = g.Ack(m.Receipt)
+	require.NoError(t, err)
+
+	v, err = tx.GetGroup(g)
+	require.NoError(t, err)
+	require.Equal(t, []byte("3"), v)
+	m, err = g.Receive(time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, []byte("3"), m.Data)
+	err = tx.Commit()
+	require.Equal(t, ErrTxnConflict, err)
+	require.Equal(t, int64(1), g.Pending())
+}
+
+func TestTxnRecover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fhck-mq")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mq, err := NewQueue(dir, nil)
+	require.NoError(t, err)
+
+	a, err := mq.Get(0)
+	require.NoError(t, err)
+	b, err := mq.Get(1)
+	require.NoError(t, err)
+	c, err := mq.Get(2)
+	require.NoError(t, err)
+
+	err = a.Put([]byte("1"))
+	require.NoError(t, err)
+
+	// crash after the record is written and the first op is applied
+	tx := mq.Txn()
+	v, err := tx.Get(a)
+	require.NoError(t, err)
+	err = tx.Put(b, v)
+	require.NoError(t, err)
+	err = tx.Put(c, v)
+	require.NoError(t, err)
+	ops := []*txnOp{tx.gets[0], tx.puts[b], tx.puts[c]}
+	ops[1].off, ops[2].off = b.idx.PutOff, c.idx.PutOff
+
+	f, err := mq.vol.Open(txnFd)
+	require.NoError(t, err)
+	_, err = f.WriteAt(encodeTxn(1, ops), txnRecordOff)
+	require.NoError(t, err)
+	err = applyTxn(ops[:2])
+	require.NoError(t, err)
+	mq.Close()
+
+	mq, err = NewQueue(dir, nil)
+	require.NoError(t, err)
+
+	for _, id := range []uint32{1, 2} {
+		topic, err := mq.Get(id)
+		require.NoError(t, err)
+		require.Equal(t, int64(1), topic.Count())
+		v, err := topic.Get()
+		require.NoError(t, err)
+		require.Equal(t, []byte("1"), v)
+	}
+	a, err = mq.Get(0)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), a.Pending())
+	require.Equal(t, int64(1), mq.txn.Seq)
+
+	// torn record is discarded
+	err = a.Put([]byte("2"))
+	require.NoError(t, err)
+	tx = mq.Txn()
+	_, err = tx.Get(a)
+	require.NoError(t, err)
+	raw := encodeTxn(2, tx.gets)
+	raw[len(raw)-1]++
+	f, err = mq.vol.Open(txnFd)
+	require.NoError(t, err)
+	_, err = f.WriteAt(raw, txnRecordOff)
+	require.NoError(t, err)
+	mq.Close()
+
+	mq, err = NewQueue(dir, nil)
+	require.NoError(t, err)
+
+	a, err = mq.Get(0)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), a.Pending())
+	require.Equal(t, int64(1), mq.txn.Seq)
+
+	// targets deleted before recovery are not created again
+	_, err = a.Group("g")
+	require.NoError(t, err)
+	tx = mq.Txn()
+	g, err := a.Group("g")
+	require.NoError(t, err)
+	_, err = tx.GetGroup(g)
+	require.NoError(t, err)
+	d, err := mq.Get(3)
+	require.NoError(t, err)
+	err = tx.Put(d, []byte("x"))
+	require.NoError(t, err)
+	ops = []*txnOp{tx.gets[0], tx.puts[d]}
+	ops[1].off = d.idx.PutOff
+	f, err = mq.vol.Open(txnFd)
+	require.NoError(t, err)
+	_, err = f.WriteAt(encodeTxn(2, ops), txnRecordOff)
+	require.NoError(t, err)
+	err = a.DeleteGroup("g")
+	require.NoError(t, err)
+	err = mq.Delete(3)
+	require.NoError(t, err)
+	mq.Close()
+
+	mq, err = NewQueue(dir, nil)
+	require.NoError(t, err)
+	defer mq.Close()
+
+	a, err = mq.Get(0)
+	require.NoError(t, err)
+	_, ok := a.FindGroup("g")
+	require.False(t, ok)
+	_, ok = mq.Find(3)
+	require.False(t, ok)
+	require.Equal(t, int64(1), a.Pending())
+	require.Equal(t, int64(2), mq.txn.Seq)
+}
@@ -0,0 +1,15 @@
+package mq
+
+// byEntry implements sort.Interface.
+type byEntry []*Group
+
+func (g byEntry) Len() int           { return len(g) }
+func (g byEntry) Less(i, j int) bool { return g[i].i < g[j].i }
+func (g byEntry) Swap(i, j int)      { g[i], g[j] = g[j], g[i] }
+
+// byID implements sort.Interface.
+type byID []*Topic
+
+func (t byID) Len() int           { return len(t) }
+func (t byID) Less(i, j int) bool { return t[i].id < t[j].id }
+func (t byID) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
@@ -0,0 +1,113 @@
+package queue
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/justmao945/tama/lmq"
+)
+
+type lmqQueue struct {
+	q      *lmq.Queue
+	topics map[uint32]*lmqTopic
+	l      sync.Mutex
+}
+
+// LMQ returns a Queue backed by q.
+func LMQ(q *lmq.Queue) Queue {
+	return &lmqQueue{q: q, topics: make(map[uint32]*lmqTopic)}
+}
+
+// topic wraps t, the same wrapper is returned for the same topic so Drop and Get
+// share one lock.
+func (q *lmqQueue) topic(t *lmq.Topic) *lmqTopic {
+	q.l.Lock()
+	defer q.l.Unlock()
+
+	lt, ok := q.topics[t.ID()]
+	if !ok {
+		lt = &lmqTopic{t: t}
+		q.topics[t.ID()] = lt
+	}
+	return lt
+}
+
+func (q *lmqQueue) Get(id uint32) (Topic, error) {
+	t, err := q.q.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	return q.topic(t), nil
+}
+
+func (q *lmqQueue) Topics() (res []Topic) {
+	for _, t := range q.q.Topics() {
+		res = append(res, q.topic(t))
+	}
+	return
+}
+
+func (q *lmqQueue) Close() {
+	q.q.Close()
+}
+
+// lmqTopic checks the message to drop by peeking the head, l makes the check and
+// drop atomic against Get.
+type lmqTopic struct {
+	t *lmq.Topic
+	l sync.Mutex
+}
+
+func lmqErr(err error) error {
+	if err == lmq.ErrClosedTopic {
+		return ErrClosedTopic
+	}
+	return err
+}
+
+func (t *lmqTopic) ID() uint32 {
+	return t.t.ID()
+}
+
+func (t *lmqTopic) Count() int64 {
+	return t.t.Count()
+}
+
+func (t *lmqTopic) Pending() int64 {
+	return t.t.Pending()
+}
+
+func (t *lmqTopic) Close() error {
+	return lmqErr(t.t.Close())
+}
+
+func (t *lmqTopic) Peek() ([]byte, error) {
+	b, err := t.t.Peek()
+	return b, lmqErr(err)
+}
+
+func (t *lmqTopic) Drop(b []byte) (err error) {
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	head, err := t.t.Peek()
+	if err != nil {
+		return lmqErr(err)
+	}
+	if !bytes.Equal(head, b) {
+		return ErrInvalidMsg
+	}
+	return lmqErr(t.t.Drop())
+}
+
+func (t *lmqTopic) Get() ([]byte, error) {
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	b, err := t.t.Get()
+	return b, lmqErr(err)
+}
+
+func (t *lmqTopic) Put(b []byte) error {
+	return lmqErr(t.t.Put(b))
+}
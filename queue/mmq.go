@@ -0,0 +1,104 @@
+package queue
+
+import (
+	"bytes"
+	"strconv"
+
+	"github.com/justmao945/tama/mmq"
+)
+
+type mmqQueue struct {
+	q *mmq.Queue
+}
+
+// MMQ returns a Queue backed by q, topic ids are formatted as decimal strings.
+// Close snapshots q if SnapshotPath is configured, errors are ignored.
+// Topics not created by this Queue are ignored by Topics.
+func MMQ(q *mmq.Queue) Queue {
+	return &mmqQueue{q: q}
+}
+
+func (q *mmqQueue) Get(id uint32) (Topic, error) {
+	t, err := q.q.Get(strconv.FormatUint(uint64(id), 10))
+	if err != nil {
+		return nil, err
+	}
+	return &mmqTopic{t: t, id: id}, nil
+}
+
+func (q *mmqQueue) Topics() (res []Topic) {
+	for _, t := range q.q.Topics() {
+		id, err := strconv.ParseUint(t.ID(), 10, 32)
+		if err != nil {
+			continue
+		}
+		res = append(res, &mmqTopic{t: t, id: uint32(id)})
+	}
+	return
+}
+
+func (q *mmqQueue) Close() {
+	q.q.Close()
+}
+
+type mmqTopic struct {
+	t  *mmq.Topic
+	id uint32
+}
+
+func mmqErr(err error) error {
+	switch err {
+	case mmq.ErrClosedTopic:
+		return ErrClosedTopic
+	case mmq.ErrInvalidReceipt:
+		return ErrInvalidMsg
+	}
+	return err
+}
+
+func (t *mmqTopic) ID() uint32 {
+	return t.id
+}
+
+func (t *mmqTopic) Count() int64 {
+	return int64(t.t.Count())
+}
+
+func (t *mmqTopic) Pending() int64 {
+	return int64(t.t.Pending())
+}
+
+func (t *mmqTopic) Close() error {
+	return mmqErr(t.t.Close())
+}
+
+func (t *mmqTopic) Peek() ([]byte, error) {
+	m, err := t.t.Peek()
+	if err != nil {
+		return nil, mmqErr(err)
+	}
+	return m.Data(), nil
+}
+
+func (t *mmqTopic) Drop(b []byte) error {
+	m, err := t.t.Peek()
+	if err != nil {
+		return mmqErr(err)
+	}
+	if !bytes.Equal(m.Data(), b) {
+		return ErrInvalidMsg
+	}
+	return mmqErr(t.t.Drop(m.Receipt()))
+}
+
+func (t *mmqTopic) Get() ([]byte, error) {
+	m, err := t.t.Get()
+	if err != nil {
+		return nil, mmqErr(err)
+	}
+	return m.Data(), nil
+}
+
+func (t *mmqTopic) Put(b []byte) error {
+	return mmqErr(t.t.Put(mmq.NewMessage(b)))
+}
@@ -0,0 +1,79 @@
+package queue
+
+import "github.com/justmao945/tama/mq"
+
+type mqQueue struct {
+	q *mq.Queue
+}
+
+// MQ returns a Queue backed by q.
+func MQ(q *mq.Queue) Queue {
+	return &mqQueue{q: q}
+}
+
+func (q *mqQueue) Get(id uint32) (Topic, error) {
+	t, err := q.q.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	return &mqTopic{t: t}, nil
+}
+
+func (q *mqQueue) Topics() (res []Topic) {
+	for _, t := range q.q.Topics() {
+		res = append(res, &mqTopic{t: t})
+	}
+	return
+}
+
+func (q *mqQueue) Close() {
+	q.q.Close()
+}
+
+type mqTopic struct {
+	t *mq.Topic
+}
+
+func mqErr(err error) error {
+	switch err {
+	case mq.ErrClosedTopic:
+		return ErrClosedTopic
+	case mq.ErrInvalidMsg:
+		return ErrInvalidMsg
+	}
+	return err
+}
+
+func (t *mqTopic) ID() uint32 {
+	return t.t.ID()
+}
+
+func (t *mqTopic) Count() int64 {
+	return t.t.Count()
+}
+
+func (t *mqTopic) Pending() int64 {
+	return t.t.Pending()
+}
+
+func (t *mqTopic) Close() error {
+	return mqErr(t.t.Close())
+}
+
+func (t *mqTopic) Peek() ([]byte, error) {
+	b, err := t.t.Peek()
+	return b, mqErr(err)
+}
+
+func (t *mqTopic) Drop(b []byte) error {
+	return mqErr(t.t.Drop(b))
+}
+
+func (t *mqTopic) Get() ([]byte, error) {
+	b, err := t.t.Get()
+	return b, mqErr(err)
+}
+
+func (t *mqTopic) Put(b []byte) error {
+	return mqErr(t.t.Put(b))
+}
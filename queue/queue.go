@@ -0,0 +1,56 @@
+// Package queue defines the interface shared by the message queues mq, mmq and lmq,
+// so callers can swap backends without rewriting.
+package queue
+
+import "errors"
+
+var (
+	// ErrClosedTopic indicates put to closed topic, or get from a closed topic without pending messages.
+	ErrClosedTopic = errors.New("closed topic")
+
+	// ErrInvalidMsg indicates drop a message which is not the first pending one.
+	ErrInvalidMsg = errors.New("invalid message")
+)
+
+// Queue can have many topics.
+type Queue interface {
+	// Get returns a topic from queue, will create a new one if is not exist.
+	Get(id uint32) (Topic, error)
+
+	// Topics returns all topics in this queue.
+	Topics() []Topic
+
+	// Close release all resources.
+	Close()
+}
+
+// Topic is a FIFO queue to put and get messages.
+//
+// Peek, Get and Drop return io.EOF if there are no pending messages, or ErrClosedTopic if
+// the topic is also closed.
+type Topic interface {
+	// ID returns unique topic id.
+	ID() uint32
+
+	// Count returns all message had been put to this topic.
+	Count() int64
+
+	// Pending returns messages can be get.
+	Pending() int64
+
+	// Close marks this topic as closed. Message can not be put to this topic after closed,
+	// but is still able to read pending messages.
+	Close() error
+
+	// Peek only returns the message, won't drop it.
+	Peek() ([]byte, error)
+
+	// Drop should only be called after Peek and with the right message.
+	Drop(b []byte) error
+
+	// Get returns a message in topic and drop it.
+	Get() ([]byte, error)
+
+	// Put a message to this topic.
+	Put(b []byte) error
+}
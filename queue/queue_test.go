@@ -0,0 +1,53 @@
+package queue_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/justmao945/tama/lmq"
+	"github.com/justmao945/tama/mmq"
+	"github.com/justmao945/tama/mq"
+	"github.com/justmao945/tama/queue"
+	"github.com/justmao945/tama/queue/queuetest"
+)
+
+func TestMQ(t *testing.T) {
+	queuetest.Run(t, queuetest.Suite{
+		Open: func(dir string) (queue.Queue, error) {
+			q, err := mq.NewQueue(dir, nil)
+			if err != nil {
+				return nil, err
+			}
+			return queue.MQ(q), nil
+		},
+		Persistent: true,
+	})
+}
+
+func TestMMQ(t *testing.T) {
+	queuetest.Run(t, queuetest.Suite{
+		Open: func(dir string) (queue.Queue, error) {
+			cfg := *mmq.DefaultConfig
+			cfg.SnapshotPath = filepath.Join(dir, "mmq")
+			q, err := mmq.RestoreFile(cfg.SnapshotPath, &cfg)
+			if err != nil {
+				return nil, err
+			}
+			return queue.MMQ(q), nil
+		},
+		Persistent: true,
+	})
+}
+
+func TestLMQ(t *testing.T) {
+	queuetest.Run(t, queuetest.Suite{
+		Open: func(dir string) (queue.Queue, error) {
+			q, err := lmq.NewQueue(filepath.Join(dir, "lmq"), 100)
+			if err != nil {
+				return nil, err
+			}
+			return queue.LMQ(q), nil
+		},
+		Persistent: true,
+	})
+}
@@ -0,0 +1,306 @@
+// Package queuetest provides the conformance suite every queue.Queue backend must pass.
+package queuetest
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/justmao945/tama/queue"
+	"github.com/stretchr/testify/require"
+)
+
+// Suite describes the backend to test.
+type Suite struct {
+	// Open opens the queue saved in dir, dir is empty at the first time.
+	Open func(dir string) (queue.Queue, error)
+
+	// Persistent means messages and states survive Close and Open with the same dir.
+	Persistent bool
+}
+
+// Run runs all conformance tests as subtests of t.
+func Run(t *testing.T, s Suite) {
+	t.Run("FIFO", func(t *testing.T) { s.run(t, testFIFO) })
+	t.Run("Drop", func(t *testing.T) { s.run(t, testDrop) })
+	t.Run("Close", func(t *testing.T) { s.run(t, testClose) })
+	t.Run("Restart", func(t *testing.T) {
+		if !s.Persistent {
+			t.Skip("not persistent")
+		}
+		s.run(t, testRestart)
+	})
+	t.Run("Concurrency", func(t *testing.T) { s.run(t, testConcurrency) })
+}
+
+func (s Suite) run(t *testing.T, f func(t *testing.T, s Suite, dir string)) {
+	dir, err := ioutil.TempDir("", "fhck-queuetest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	f(t, s, dir)
+}
+
+func msg(i int) []byte {
+	return []byte(fmt.Sprintf("msg-%d", i))
+}
+
+func testFIFO(t *testing.T, s Suite, dir string) {
+	q, err := s.Open(dir)
+	require.NoError(t, err)
+	defer q.Close()
+
+	topic, err := q.Get(1)
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), topic.ID())
+
+	_, err = topic.Peek()
+	require.Equal(t, io.EOF, err)
+	_, err = topic.Get()
+	require.Equal(t, io.EOF, err)
+
+	const n = 100
+	for i := 0; i < n; i++ {
+		require.NoError(t, topic.Put(msg(i)))
+	}
+	require.Equal(t, int64(n), topic.Count())
+	require.Equal(t, int64(n), topic.Pending())
+
+	for i := 0; i < n; i++ {
+		b, err := topic.Peek()
+		require.NoError(t, err)
+		require.Equal(t, msg(i), b)
+
+		b, err = topic.Get()
+		require.NoError(t, err)
+		require.Equal(t, msg(i), b)
+		require.Equal(t, int64(n-i-1), topic.Pending())
+	}
+	require.Equal(t, int64(n), topic.Count())
+
+	_, err = topic.Get()
+	require.Equal(t, io.EOF, err)
+
+	other, err := q.Get(2)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), other.Count())
+
+	again, err := q.Get(1)
+	require.NoError(t, err)
+	require.Equal(t, int64(n), again.Count())
+	require.Len(t, q.Topics(), 2)
+}
+
+func testDrop(t *testing.T, s Suite, dir string) {
+	q, err := s.Open(dir)
+	require.NoError(t, err)
+	defer q.Close()
+
+	topic, err := q.Get(1)
+	require.NoError(t, err)
+
+	require.Equal(t, io.EOF, topic.Drop(msg(0)))
+
+	require.NoError(t, topic.Put(msg(0)))
+	require.NoError(t, topic.Put(msg(1)))
+
+	require.Equal(t, queue.ErrInvalidMsg, topic.Drop(msg(1)))
+	require.Equal(t, int64(2), topic.Pending())
+
+	b, err := topic.Peek()
+	require.NoError(t, err)
+	require.NoError(t, topic.Drop(b))
+
+	b, err = topic.Peek()
+	require.NoError(t, err)
+	require.Equal(t, msg(1), b)
+	require.NoError(t, topic.Drop(b))
+	require.Equal(t, int64(0), topic.Pending())
+}
+
+func testClose(t *testing.T, s Suite, dir string) {
+	q, err := s.Open(dir)
+	require.NoError(t, err)
+	defer q.Close()
+
+	topic, err := q.Get(1)
+	require.NoError(t, err)
+
+	require.NoError(t, topic.Put(msg(0)))
+	require.NoError(t, topic.Close())
+	require.NoError(t, topic.Close())
+
+	require.Equal(t, queue.ErrClosedTopic, topic.Put(msg(1)))
+	require.Equal(t, int64(1), topic.Count())
+
+	b, err := topic.Peek()
+	require.NoError(t, err)
+	require.Equal(t, msg(0), b)
+
+	b, err = topic.Get()
+	require.NoError(t, err)
+	require.Equal(t, msg(0), b)
+
+	_, err = topic.Peek()
+	require.Equal(t, queue.ErrClosedTopic, err)
+	_, err = topic.Get()
+	require.Equal(t, queue.ErrClosedTopic, err)
+	require.Equal(t, queue.ErrClosedTopic, topic.Drop(msg(0)))
+
+	other, err := q.Get(2)
+	require.NoError(t, err)
+	require.NoError(t, other.Put(msg(0)))
+}
+
+func testRestart(t *testing.T, s Suite, dir string) {
+	q, err := s.Open(dir)
+	require.NoError(t, err)
+
+	topic, err := q.Get(1)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		require.NoError(t, topic.Put(msg(i)))
+	}
+	for i := 0; i < 3; i++ {
+		_, err = topic.Get()
+		require.NoError(t, err)
+	}
+
+	closed, err := q.Get(2)
+	require.NoError(t, err)
+	require.NoError(t, closed.Put(msg(0)))
+	require.NoError(t, closed.Close())
+	q.Close()
+
+	q, err = s.Open(dir)
+	require.NoError(t, err)
+	defer q.Close()
+	require.Len(t, q.Topics(), 2)
+
+	topic, err = q.Get(1)
+	require.NoError(t, err)
+	require.Equal(t, int64(10), topic.Count())
+	require.Equal(t, int64(7), topic.Pending())
+	for i := 3; i < 10; i++ {
+		b, err := topic.Get()
+		require.NoError(t, err)
+		require.Equal(t, msg(i), b)
+	}
+	_, err = topic.Get()
+	require.Equal(t, io.EOF, err)
+	require.NoError(t, topic.Put(msg(10)))
+
+	closed, err = q.Get(2)
+	require.NoError(t, err)
+	require.Equal(t, queue.ErrClosedTopic, closed.Put(msg(1)))
+	b, err := closed.Get()
+	require.NoError(t, err)
+	require.Equal(t, msg(0), b)
+	_, err = closed.Get()
+	require.Equal(t, queue.ErrClosedTopic, err)
+}
+
+// testConcurrency puts messages to two topics from many producers, and gets them from many
+// consumers. Each message must be got exactly once, and in the put order of its producer.
+func testConcurrency(t *testing.T, s Suite, dir string) {
+	const producers, consumers, n = 4, 4, 200
+
+	q, err := s.Open(dir)
+	require.NoError(t, err)
+	defer q.Close()
+
+	var topics []queue.Topic
+	for id := uint32(1); id <= 2; id++ {
+		topic, err := q.Get(id)
+		require.NoError(t, err)
+		topics = append(topics, topic)
+	}
+
+	var (
+		done int32
+		pwg  sync.WaitGroup
+		cwg  sync.WaitGroup
+		errs = make(chan error, producers+consumers)
+		got  = make([][][2]int, consumers)
+	)
+
+	for p := 0; p < producers; p++ {
+		pwg.Add(1)
+		go func(p int) {
+			defer pwg.Done()
+			topic := topics[p%len(topics)]
+			for i := 0; i < n; i++ {
+				err := topic.Put([]byte(fmt.Sprintf("%d-%d", p, i)))
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(p)
+	}
+
+	for c := 0; c < consumers; c++ {
+		cwg.Add(1)
+		go func(c int) {
+			defer cwg.Done()
+			for {
+				finished := atomic.LoadInt32(&done) == 1
+				empty := true
+				for _, topic := range topics {
+					b, err := topic.Get()
+					if err == io.EOF {
+						continue
+					}
+					if err != nil {
+						errs <- err
+						return
+					}
+					var p, i int
+					_, err = fmt.Sscanf(string(b), "%d-%d", &p, &i)
+					if err != nil {
+						errs <- err
+						return
+					}
+					got[c] = append(got[c], [2]int{p, i})
+					empty = false
+				}
+				if empty && finished {
+					return
+				}
+			}
+		}(c)
+	}
+
+	pwg.Wait()
+	atomic.StoreInt32(&done, 1)
+	cwg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	seen := make(map[[2]int]bool)
+	for _, msgs := range got {
+		last := make(map[int]int)
+		for _, m := range msgs {
+			require.False(t, seen[m], "message %v got twice", m)
+			seen[m] = true
+			if i, ok := last[m[0]]; ok {
+				require.True(t, m[1] > i, "message %v got after %v", m, i)
+			}
+			last[m[0]] = m[1]
+		}
+	}
+	require.Len(t, seen, producers*n)
+
+	var count int64
+	for _, topic := range topics {
+		count += topic.Count()
+		require.Equal(t, int64(0), topic.Pending())
+	}
+	require.Equal(t, int64(producers*n), count)
+}